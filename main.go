@@ -35,16 +35,46 @@ func init() {
 	models.SetDB()
 	models.Migrate()
 	models.SetCache()
-
+	controllers.SetTargetList()
+	controllers.SetRulesCache()
+	controllers.SetEventRules()
+	controllers.StartDispatcher()
+	controllers.StartLogSource()
 }
 
 func main() {
 	r := gin.Default()
 	r.RedirectTrailingSlash = false
+	r.GET("/", controllers.GetBucketNotification)
+	r.PUT("/", controllers.PutBucketNotification)
 	r.GET("/:bucket", controllers.GetBucketNotification)
 	r.PUT("/:bucket", controllers.PutBucketNotification)
 
 	r.NoRoute(controllers.ReverseProxy())
 
+	admin := gin.Default()
+	admin.GET("/events/failed", controllers.ListFailedEvents)
+	admin.POST("/events/failed/:id/retry", controllers.RetryFailedEvent)
+	admin.POST("/events/replay", controllers.ReplayEvents)
+	admin.GET("/targets", controllers.ListTargets)
+	admin.PUT("/targets/:type/:name", controllers.PutTarget)
+	admin.DELETE("/targets/:type/:name", controllers.DeleteTarget)
+	admin.GET("/rules", controllers.ListEventRules)
+	admin.PUT("/rules/:name", controllers.PutEventRule)
+	admin.DELETE("/rules/:name", controllers.DeleteEventRule)
+	admin.GET("/functions", controllers.ListFunctions)
+	admin.PUT("/functions/:account/:name", controllers.PutFunction)
+	admin.DELETE("/functions/:account/:name", controllers.DeleteFunction)
+	admin.GET("/functions/:account/:name/invocations", controllers.ListFunctionInvocations)
+	admin.GET("/replications", controllers.ListReplications)
+	admin.PUT("/replications/:bucket", controllers.PutReplication)
+	admin.DELETE("/replications/:bucket", controllers.DeleteReplication)
+	admin.GET("/replications/:bucket/status", controllers.GetReplicationStatus)
+	go func() {
+		if err := admin.Run(config.GetServerConfig().AdminAddr); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
 	r.Run()
 }
@@ -15,7 +15,10 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package config
 
 import (
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/minio/minio/cmd"
 
@@ -25,19 +28,101 @@ import (
 var serverConfig *ServerConfig
 
 type ServerConfig struct {
-	Region      string
-	Host        string
-	AuthBackend AuthenticationBackend
+	Region         string
+	Host           string
+	AuthBackend    AuthenticationBackend
+	SNSEndpoint    string
+	AdminAddr      string
+	AdminAccounts  []string
+	EventRetention time.Duration
+	SMTP           SMTPConfig
+	RGW            RGWConfig
+}
+
+// RGWConfig is the backend kaoliang proxies to. The keys, when set, sign
+// the requests kaoliang makes on its own, e.g. to read object metadata.
+// With a log poll interval, writes which bypass kaoliang are read from the
+// logs of RGW with the admin command. Writes kaoliang already reported are
+// recognized within the dedup window only, so the logs must not be read
+// further behind than that.
+type RGWConfig struct {
+	Host            string
+	AccessKey       string
+	SecretKey       string
+	AdminCommand    string
+	LogPollInterval time.Duration
+	DedupWindow     time.Duration
+}
+
+type SMTPConfig struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
 }
 
 func SetServerConfig() {
+	host := utils.GetEnv("RGW_DNS_NAME", "cloud.inwinstack.com")
+
+	eventRetention, err := time.ParseDuration(utils.GetEnv("EVENT_RETENTION", "168h"))
+	if err != nil {
+		log.Fatalf("invalid EVENT_RETENTION: %v", err)
+	}
+
+	logPollInterval, err := time.ParseDuration(utils.GetEnv("RGW_LOG_POLL_INTERVAL", "0s"))
+	if err != nil {
+		log.Fatalf("invalid RGW_LOG_POLL_INTERVAL: %v", err)
+	}
+
+	dedupWindow, err := time.ParseDuration(utils.GetEnv("RGW_LOG_DEDUP_WINDOW", "10m"))
+	if err != nil {
+		log.Fatalf("invalid RGW_LOG_DEDUP_WINDOW: %v", err)
+	}
+
+	adminAccounts := []string{}
+	for _, id := range strings.Split(utils.GetEnv("ADMIN_ACCOUNTS", ""), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			adminAccounts = append(adminAccounts, id)
+		}
+	}
+
 	serverConfig = &ServerConfig{
-		Region:      utils.GetEnv("RGW_REGION", "us-east-1"),
-		Host:        utils.GetEnv("RGW_DNS_NAME", "cloud.inwinstack.com"),
-		AuthBackend: SetAuthBackend(utils.GetEnv("AUTH_BACKEND", "DummyBackend")),
+		Region:         utils.GetEnv("RGW_REGION", "us-east-1"),
+		Host:           host,
+		AuthBackend:    SetAuthBackend(utils.GetEnv("AUTH_BACKEND", "DummyBackend")),
+		SNSEndpoint:    utils.GetEnv("SNS_ENDPOINT", "http://"+host),
+		AdminAddr:      utils.GetEnv("ADMIN_ADDR", ":8081"),
+		AdminAccounts:  adminAccounts,
+		EventRetention: eventRetention,
+		SMTP: SMTPConfig{
+			Addr:     utils.GetEnv("SMTP_ADDR", "localhost:25"),
+			Username: utils.GetEnv("SMTP_USERNAME", ""),
+			Password: utils.GetEnv("SMTP_PASSWORD", ""),
+			From:     utils.GetEnv("SMTP_FROM", "no-reply@"+host),
+		},
+		RGW: RGWConfig{
+			Host:            utils.GetEnv("TARGET_HOST", "127.0.0.1"),
+			AccessKey:       utils.GetEnv("RGW_ACCESS_KEY", ""),
+			SecretKey:       utils.GetEnv("RGW_SECRET_KEY", ""),
+			AdminCommand:    utils.GetEnv("RADOSGW_ADMIN", "radosgw-admin"),
+			LogPollInterval: logPollInterval,
+			DedupWindow:     dedupWindow,
+		},
 	}
 }
 
+// IsAdmin reports whether accountID may manage the gateway itself, like the
+// webhook targets.
+func (c *ServerConfig) IsAdmin(accountID string) bool {
+	for _, id := range c.AdminAccounts {
+		if id == accountID {
+			return true
+		}
+	}
+
+	return false
+}
+
 func GetServerConfig() *ServerConfig {
 	return serverConfig
 }
@@ -15,14 +15,47 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package controllers
 
 import (
+	"context"
 	"net/http"
+	"sync"
 
 	"github.com/minio/minio/cmd"
 
 	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
 )
 
 func authenticate(r *http.Request) (string, cmd.APIErrorCode) {
 	config := config.GetServerConfig()
 	return config.AuthBackend.GetUser(r)
 }
+
+type principalKey struct{}
+
+// requestAuth is the user who signed a proxied request. It is only
+// verified when the first event of the request needs it.
+type requestAuth struct {
+	once      sync.Once
+	principal string
+}
+
+// withRequestAuth returns req with a place on its context to keep the user
+// who signed it, which the requests made from it share.
+func withRequestAuth(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), principalKey{}, &requestAuth{}))
+}
+
+// isTopicActionAllowed evaluates action against the access policy of topic.
+// The topic owner is always allowed.
+func isTopicActionAllowed(accountID string, topic models.Resource, action string) bool {
+	if accountID == topic.AccountID {
+		return true
+	}
+
+	policy, err := models.ParsePolicy(topic.Policy)
+	if err != nil {
+		return false
+	}
+
+	return policy.IsAllowed(accountID, "SNS:"+action, topic.ARN())
+}
@@ -0,0 +1,195 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio/cmd"
+	"github.com/satori/go.uuid"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+const redriveLockTTL = 5 * time.Minute
+
+// DeadLetter is the message stored in the dead-letter queue of a
+// subscription once delivery has run out of retries.
+type DeadLetter struct {
+	SubscriptionARN string       `json:"SubscriptionArn"`
+	Protocol        string       `json:"Protocol"`
+	Endpoint        string       `json:"Endpoint"`
+	ErrorMessage    string       `json:"ErrorMessage"`
+	Attempts        int          `json:"Attempts"`
+	FailedAt        string       `json:"FailedAt"`
+	Notification    Notification `json:"Notification"`
+}
+
+func deadLetterQueueKey(endpoint models.Endpoint) (string, bool) {
+	if endpoint.RedrivePolicy == "" {
+		return "", false
+	}
+
+	policy, err := models.ParseRedrivePolicy(endpoint.RedrivePolicy)
+	if err != nil {
+		return "", false
+	}
+
+	queue, _ := models.ParseARN(policy.DeadLetterTargetARN)
+	return fmt.Sprintf("sqs:%s:%s", queue.AccountID, queue.Name), true
+}
+
+func sendToDeadLetterQueue(topic models.Resource, endpoint models.Endpoint, notification Notification, attempts int, deliveryErr error) error {
+	key, ok := deadLetterQueueKey(endpoint)
+	if !ok {
+		return deliveryErr
+	}
+
+	data, err := json.Marshal(DeadLetter{
+		SubscriptionARN: topic.ARN() + ":" + endpoint.Name,
+		Protocol:        endpoint.Protocol,
+		Endpoint:        endpoint.URI,
+		ErrorMessage:    deliveryErr.Error(),
+		Attempts:        attempts,
+		FailedAt:        time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		Notification:    notification,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := models.GetCache()
+	return client.RPush(key, data).Err()
+}
+
+// RedriveDeadLetters delivers the messages waiting in the dead-letter queue
+// of a subscription back to it in the background. Messages of other
+// subscriptions sharing the queue, and messages that fail again, stay in
+// the queue.
+func RedriveDeadLetters(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	topic, subscription, ok := findSubscription(c, c.PostForm("SubscriptionArn"))
+	if !ok {
+		return
+	}
+
+	if accountID != topic.AccountID && accountID != subscription.Owner {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	key, ok := deadLetterQueueKey(subscription)
+	if !ok {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Subscription has no RedrivePolicy")
+		return
+	}
+
+	requestID, _ := uuid.NewV4()
+	subscriptionARN := topic.ARN() + ":" + subscription.Name
+	lock := &redisLock{
+		key:   fmt.Sprintf("%s:redrive:%s:lock", key, subscriptionARN),
+		owner: requestID.String(),
+		ttl:   redriveLockTTL,
+	}
+	if ok, err := lock.acquire(); err != nil {
+		writeErrorResponse(c, cmd.ErrInternalError)
+		return
+	} else if !ok {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: A redrive of the subscription is already in progress")
+		return
+	}
+
+	length, err := models.GetCache().LLen(key).Result()
+	if err != nil {
+		lock.release()
+		writeErrorResponse(c, cmd.ErrInternalError)
+		return
+	}
+
+	go func() {
+		defer lock.release()
+		redriveDeadLetters(topic, subscription, key, length, lock)
+	}()
+
+	body := RedriveDeadLettersResponse{
+		Pending:   length,
+		RequestID: requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+// redriveDeadLetters moves each dead letter into a processing list of the
+// subscription while it is delivered, so none is lost if the process stops
+// midway; the next redrive returns what it finds there to the queue first.
+func redriveDeadLetters(topic models.Resource, subscription models.Endpoint, key string, length int64, lock *redisLock) {
+	client := models.GetCache()
+	subscriptionARN := topic.ARN() + ":" + subscription.Name
+	processing := fmt.Sprintf("%s:redrive:%s", key, subscriptionARN)
+
+	// Return what an interrupted redrive left in processing to the queue.
+	for client.RPopLPush(processing, key).Err() == nil {
+	}
+
+	for i := int64(0); i < length; i++ {
+		if ok, _ := lock.renew(); !ok {
+			return
+		}
+
+		data, err := client.RPopLPush(key, processing).Result()
+		if err != nil {
+			break
+		}
+
+		deadLetter := DeadLetter{}
+		if json.Unmarshal([]byte(data), &deadLetter) != nil || deadLetter.SubscriptionARN != subscriptionARN {
+			requeueDeadLetter(key, processing, data, data)
+			continue
+		}
+
+		if err := deliver(topic, subscription, deadLetter.Notification); err != nil {
+			log.Printf("redrive to subscription %s failed: %v", subscription.Name, err)
+			deadLetter.ErrorMessage = err.Error()
+			deadLetter.Attempts++
+			deadLetter.FailedAt = time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+			retry, _ := json.Marshal(deadLetter)
+			requeueDeadLetter(key, processing, data, string(retry))
+			continue
+		}
+
+		client.LRem(processing, 1, data)
+	}
+}
+
+// requeueDeadLetter puts a dead letter taken into processing back at the
+// other end of the queue, so the rest of the queue is visited before it.
+func requeueDeadLetter(key, processing, data, requeued string) {
+	pipe := models.GetCache().TxPipeline()
+	pipe.LPush(key, requeued)
+	pipe.LRem(processing, 1, data)
+	if _, err := pipe.Exec(); err != nil {
+		log.Printf("requeueing dead letter to %s failed: %v", key, err)
+	}
+}
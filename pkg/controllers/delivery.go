@@ -0,0 +1,178 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+const (
+	maxDeliveryAttempts = 4
+	deliveryRetryDelay  = time.Second
+)
+
+var deliveryClient = &http.Client{Timeout: 15 * time.Second}
+
+// Notification is the document delivered to the subscriptions of a topic.
+type Notification struct {
+	Type           string `json:"Type"`
+	MessageID      string `json:"MessageId"`
+	TopicARN       string `json:"TopicArn"`
+	Subject        string `json:"Subject,omitempty"`
+	Message        string `json:"Message"`
+	Timestamp      string `json:"Timestamp"`
+	SequenceNumber string `json:"SequenceNumber,omitempty"`
+	UnsubscribeURL string `json:"UnsubscribeURL,omitempty"`
+}
+
+func validateEndpoint(protocol, endpoint string) error {
+	switch {
+	case protocol == "http" || protocol == "https":
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != protocol || u.Host == "" {
+			return fmt.Errorf("endpoint must be an %s URL", protocol)
+		}
+	case protocol == "sqs":
+		queue, err := models.ParseARN(endpoint)
+		if err != nil {
+			return err
+		}
+		if queue.Service != models.SQS {
+			return errors.New("endpoint must be a queue ARN")
+		}
+	case isEmailProtocol(protocol):
+		return validateEmailAddress(endpoint)
+	case isBrokerProtocol(protocol):
+		_, err := parseBrokerArgs(protocol, endpoint)
+		return err
+	default:
+		return fmt.Errorf("unknown protocol %s", protocol)
+	}
+
+	return nil
+}
+
+// publish fans notification out to the confirmed subscriptions of topic.
+// Subscriptions of FIFO topics are served one after another before
+// returning, so messages reach them in the order they were published.
+func publish(topic models.Resource, notification Notification) {
+	db := models.GetDB()
+	endpoints := []models.Endpoint{}
+	db.Where(models.Endpoint{ResourceID: topic.ID}).Order("id").Find(&endpoints)
+
+	for _, endpoint := range endpoints {
+		if endpoint.PendingConfirmation {
+			continue
+		}
+
+		send := func(endpoint models.Endpoint) {
+			if err := deliverWithRetry(topic, endpoint, notification); err != nil {
+				log.Printf("delivery to subscription %s failed: %v", endpoint.Name, err)
+			}
+		}
+
+		if topic.IsFIFO() {
+			send(endpoint)
+		} else {
+			go send(endpoint)
+		}
+	}
+}
+
+// deliverWithRetry retries a failed delivery with exponential backoff. When
+// every attempt fails the notification is moved to the dead-letter queue of
+// the subscription, if it has one.
+func deliverWithRetry(topic models.Resource, endpoint models.Endpoint, notification Notification) error {
+	var err error
+	delay := deliveryRetryDelay
+	for attempt := 1; attempt <= maxDeliveryAttempts; attempt++ {
+		if err = deliver(topic, endpoint, notification); err == nil {
+			return nil
+		}
+
+		if attempt < maxDeliveryAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return sendToDeadLetterQueue(topic, endpoint, notification, maxDeliveryAttempts, err)
+}
+
+func deliver(topic models.Resource, endpoint models.Endpoint, notification Notification) error {
+	if isEmailProtocol(endpoint.Protocol) {
+		return sendNotificationMail(topic, endpoint, notification)
+	}
+
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	switch endpoint.Protocol {
+	case "sqs":
+		queue, err := models.ParseARN(endpoint.URI)
+		if err != nil {
+			return err
+		}
+
+		owner := endpoint.Owner
+		if owner == "" {
+			owner = topic.AccountID
+		}
+		if queue.AccountID != owner {
+			return fmt.Errorf("queue %s belongs to another account", endpoint.URI)
+		}
+
+		client := models.GetCache()
+		return client.RPush(fmt.Sprintf("sqs:%s:%s", queue.AccountID, queue.Name), data).Err()
+	case "http", "https":
+		req, err := http.NewRequest("POST", endpoint.URI, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+		req.Header.Set("x-amz-sns-message-type", "Notification")
+		req.Header.Set("x-amz-sns-topic-arn", topic.ARN())
+		req.Header.Set("x-amz-sns-subscription-arn", topic.ARN()+":"+endpoint.Name)
+
+		resp, err := deliveryClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("endpoint responded with %s", resp.Status)
+		}
+
+		return nil
+	default:
+		return publishToBroker(endpoint, topic.ARN(), data)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+func isEmailProtocol(protocol string) bool {
+	return protocol == "email" || protocol == "email-json"
+}
+
+func validateEmailAddress(address string) error {
+	_, err := emailAddress(address)
+	return err
+}
+
+// emailAddress is the bare address of an endpoint, which may name the
+// recipient too, as in "Name <user@example.com>".
+func emailAddress(endpoint string) (string, error) {
+	addr, err := mail.ParseAddress(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	return addr.Address, nil
+}
+
+func confirmationURL(topic models.Resource, endpoint models.Endpoint) string {
+	serverConfig := config.GetServerConfig()
+	query := url.Values{
+		"Action":   {"ConfirmSubscription"},
+		"TopicArn": {topic.ARN()},
+		"Token":    {endpoint.Token},
+	}
+
+	return serverConfig.SNSEndpoint + "/?" + query.Encode()
+}
+
+func unsubscribeURL(topic models.Resource, endpoint models.Endpoint) string {
+	serverConfig := config.GetServerConfig()
+	query := url.Values{
+		"Action":          {"Unsubscribe"},
+		"SubscriptionArn": {topic.ARN() + ":" + endpoint.Name},
+		"Token":           {endpoint.Token},
+	}
+
+	return serverConfig.SNSEndpoint + "/?" + query.Encode()
+}
+
+func sendMail(to, subject, body string) error {
+	smtpConfig := config.GetServerConfig().SMTP
+
+	rcpt, err := emailAddress(to)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if smtpConfig.Username != "" {
+		host := strings.Split(smtpConfig.Addr, ":")[0]
+		auth = smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", smtpConfig.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(&msg, "\r\n%s", strings.Replace(body, "\n", "\r\n", -1))
+
+	return smtp.SendMail(smtpConfig.Addr, auth, smtpConfig.From, []string{rcpt}, msg.Bytes())
+}
+
+func sendConfirmationMail(topic models.Resource, endpoint models.Endpoint) error {
+	body := fmt.Sprintf("You have chosen to subscribe to the topic:\n%s\n\n"+
+		"To confirm this subscription, click or visit the link below "+
+		"(If this was in error no action is necessary):\n%s\n",
+		topic.ARN(), confirmationURL(topic, endpoint))
+
+	return sendMail(endpoint.URI, "Subscription Confirmation", body)
+}
+
+func sendNotificationMail(topic models.Resource, endpoint models.Endpoint, notification Notification) error {
+	subject := notification.Subject
+	if subject == "" {
+		subject = "Notification"
+	}
+
+	link := unsubscribeURL(topic, endpoint)
+
+	var body string
+	if endpoint.Protocol == "email-json" {
+		notification.UnsubscribeURL = link
+		data, err := json.Marshal(notification)
+		if err != nil {
+			return err
+		}
+		body = string(data)
+	} else {
+		body = fmt.Sprintf("%s\n\n--\nIf you wish to stop receiving notifications from this topic, "+
+			"please click or visit the link below to unsubscribe:\n%s\n", notification.Message, link)
+	}
+
+	return sendMail(endpoint.URI, subject, body)
+}
@@ -0,0 +1,457 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+// eventRule is a compiled event rule. Its pattern is matched against the
+// event records as they are delivered, so object keys are URL encoded.
+type eventRule struct {
+	name      string
+	pattern   *eventPattern
+	targetIDs []event.TargetID
+}
+
+func parseTargetARN(arn string) (event.TargetID, error) {
+	if strings.HasPrefix(arn, "arn:aws:lambda:") {
+		return parseFunctionARN(arn)
+	}
+
+	resource, err := models.ParseARN(arn)
+	if err != nil {
+		return event.TargetID{}, err
+	}
+
+	return event.TargetID{Service: resource.Service.String(), ID: resource.AccountID, Name: resource.Name}, nil
+}
+
+// isRuleTargetAllowed reports whether rules of accountID may send events to
+// a target, which it has to own unless an administrator registered it.
+func isRuleTargetAllowed(accountID string, targetID event.TargetID) bool {
+	if targetID.ID == accountID {
+		return true
+	}
+
+	if targetID.Service != models.SQS.String() || !isRegisteredTargetType(targetID.Name) {
+		return false
+	}
+
+	db := models.GetDB()
+	return !db.Where("name = ? AND type = ?", targetID.ID, targetID.Name).First(&models.Target{}).RecordNotFound()
+}
+
+func newEventRule(rule models.EventRule) (*eventRule, error) {
+	pattern, err := compileEventPattern([]byte(rule.Pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	arns := []string{}
+	if err := json.Unmarshal([]byte(rule.Targets), &arns); err != nil {
+		return nil, err
+	}
+
+	compiled := &eventRule{name: rule.Name, pattern: pattern}
+	for _, arn := range arns {
+		targetID, err := parseTargetARN(arn)
+		if err != nil {
+			return nil, err
+		}
+		compiled.targetIDs = append(compiled.targetIDs, targetID)
+	}
+
+	return compiled, nil
+}
+
+// eventRuleCache holds the compiled event rules of every account, by the
+// event names their patterns can match, and the owner of each bucket of the
+// accounts with rules. All of them are loaded, so accounts without rules,
+// and events no rule can match, cost nothing.
+type eventRuleCache struct {
+	sync.RWMutex
+	rules  map[string]map[event.Name][]*eventRule
+	events map[event.Name]bool
+	owners map[string]string
+}
+
+var accountRules = &eventRuleCache{
+	rules:  map[string]map[event.Name][]*eventRule{},
+	events: map[event.Name]bool{},
+	owners: map[string]string{},
+}
+
+// ruleEventNames are the names events are sent with.
+var ruleEventNames = []event.Name{
+	event.ObjectAccessedGet,
+	event.ObjectAccessedHead,
+	event.ObjectCreatedCompleteMultipartUpload,
+	event.ObjectCreatedCopy,
+	event.ObjectCreatedPost,
+	event.ObjectCreatedPut,
+	event.ObjectRemovedDelete,
+	event.ObjectRemovedDeleteMarkerCreated,
+	event.ObjectTaggingPut,
+	event.ObjectTaggingDelete,
+	event.ObjectAclPut,
+	event.BucketCreated,
+	event.BucketRemoved,
+}
+
+func (c *eventRuleCache) get(accountID string, eventType event.Name) []*eventRule {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.rules[accountID][eventType]
+}
+
+// getByBucket returns the rules of the owner of bucket which can match
+// eventType.
+func (c *eventRuleCache) getByBucket(bucket string, eventType event.Name) []*eventRule {
+	c.RLock()
+	defer c.RUnlock()
+
+	owner, ok := c.owners[bucket]
+	if !ok {
+		return nil
+	}
+
+	return c.rules[owner][eventType]
+}
+
+// hasRules reports whether accountID has any rule.
+func (c *eventRuleCache) hasRules(accountID string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return len(c.rules[accountID]) > 0
+}
+
+// matches reports whether a rule of any account can match eventType.
+func (c *eventRuleCache) matches(eventType event.Name) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.events[eventType]
+}
+
+func compileEventRules(rules []models.EventRule) map[string]map[event.Name][]*eventRule {
+	compiled := map[string]map[event.Name][]*eventRule{}
+	for _, rule := range rules {
+		r, err := newEventRule(rule)
+		if err != nil {
+			log.Printf("loading rule %s of %s failed: %v", rule.Name, rule.AccountID, err)
+			continue
+		}
+
+		for _, name := range ruleEventNames {
+			if !r.pattern.matchesEventName(name.String()) {
+				continue
+			}
+			if compiled[rule.AccountID] == nil {
+				compiled[rule.AccountID] = map[event.Name][]*eventRule{}
+			}
+			compiled[rule.AccountID][name] = append(compiled[rule.AccountID][name], r)
+		}
+	}
+
+	return compiled
+}
+
+// indexEvents notes the event names any rule can match. It is called with
+// the lock held.
+func (c *eventRuleCache) indexEvents() {
+	c.events = map[event.Name]bool{}
+	for _, rules := range c.rules {
+		for name := range rules {
+			c.events[name] = true
+		}
+	}
+}
+
+// setBuckets replaces the buckets indexed for accountID. It is called with
+// the lock held.
+func (c *eventRuleCache) setBuckets(accountID string, buckets []string) {
+	for bucket, owner := range c.owners {
+		if owner == accountID {
+			delete(c.owners, bucket)
+		}
+	}
+	for _, bucket := range buckets {
+		c.owners[bucket] = accountID
+	}
+}
+
+func (c *eventRuleCache) load(accountID string) error {
+	db := models.GetDB()
+	rules := []models.EventRule{}
+	if err := db.Where("account_id = ?", accountID).Order("name").Find(&rules).Error; err != nil {
+		return err
+	}
+
+	compiled := compileEventRules(rules)
+
+	var buckets []string
+	if len(compiled[accountID]) > 0 {
+		var err error
+		if buckets, err = listAccountBuckets(accountID); err != nil {
+			return err
+		}
+	}
+
+	c.Lock()
+	if len(compiled[accountID]) == 0 {
+		delete(c.rules, accountID)
+	} else {
+		c.rules[accountID] = compiled[accountID]
+	}
+	c.setBuckets(accountID, buckets)
+	c.indexEvents()
+	c.Unlock()
+
+	return nil
+}
+
+func (c *eventRuleCache) reload() error {
+	db := models.GetDB()
+	rules := []models.EventRule{}
+	if err := db.Order("account_id, name").Find(&rules).Error; err != nil {
+		return err
+	}
+
+	compiled := compileEventRules(rules)
+
+	// The buckets of an account which can't be listed now are kept as they
+	// were.
+	listed := map[string][]string{}
+	for accountID := range compiled {
+		buckets, err := listAccountBuckets(accountID)
+		if err != nil {
+			log.Printf("listing buckets of %s failed: %v", accountID, err)
+			continue
+		}
+		listed[accountID] = buckets
+	}
+
+	c.Lock()
+	owners := map[string]string{}
+	for bucket, owner := range c.owners {
+		if _, ok := listed[owner]; !ok && compiled[owner] != nil {
+			owners[bucket] = owner
+		}
+	}
+	for accountID, buckets := range listed {
+		for _, bucket := range buckets {
+			owners[bucket] = accountID
+		}
+	}
+	c.rules = compiled
+	c.owners = owners
+	c.indexEvents()
+	c.Unlock()
+
+	return nil
+}
+
+// SetEventRules loads the event rules of all accounts and keeps them up to
+// date with the changes any process announces.
+func SetEventRules() {
+	client := models.GetCache()
+	pubsub := client.Subscribe(models.EventRuleChannel)
+	if _, err := pubsub.Receive(); err != nil {
+		log.Fatalf("subscribing to %s failed: %v", models.EventRuleChannel, err)
+	}
+
+	if err := accountRules.reload(); err != nil {
+		log.Fatalf("loading event rules failed: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(rulesCacheTTL)
+		defer ticker.Stop()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case msg := <-messages:
+				if err := accountRules.load(msg.Payload); err != nil {
+					log.Printf("loading event rules of %s failed: %v", msg.Payload, err)
+				}
+			case <-ticker.C:
+				if err := accountRules.reload(); err != nil {
+					log.Printf("reloading event rules failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// bucketAccountRules returns the event rules of the owner of bucket which
+// can match eventType. Only the buckets of accounts with rules are indexed,
+// so other requests cost no more than a map lookup.
+func bucketAccountRules(bucketName string, eventType event.Name) []*eventRule {
+	if !accountRules.matches(eventType) {
+		return nil
+	}
+
+	return accountRules.getByBucket(bucketName, eventType)
+}
+
+// matchEventRules returns the targets the rules send newEvent to, with the
+// name of the first rule that matched each.
+func matchEventRules(rules []*eventRule, newEvent event.Event) map[event.TargetID]string {
+	targets := map[event.TargetID]string{}
+
+	data, err := json.Marshal(newEvent)
+	if err != nil {
+		return targets
+	}
+	var fields interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return targets
+	}
+
+	for _, rule := range rules {
+		if !rule.pattern.match(fields, true) {
+			continue
+		}
+
+		for _, targetID := range rule.targetIDs {
+			if _, ok := targets[targetID]; !ok {
+				targets[targetID] = rule.name
+			}
+		}
+	}
+
+	return targets
+}
+
+func newEventRuleResponse(rule models.EventRule) EventRuleResponse {
+	targets := []string{}
+	json.Unmarshal([]byte(rule.Targets), &targets)
+
+	return EventRuleResponse{
+		Name:    rule.Name,
+		Pattern: json.RawMessage(rule.Pattern),
+		Targets: targets,
+	}
+}
+
+// ListEventRules lists the event rules of the caller.
+func ListEventRules(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	db := models.GetDB()
+	rules := []models.EventRule{}
+	db.Where("account_id = ?", accountID).Order("name").Find(&rules)
+
+	body := EventRulesResponse{Rules: []EventRuleResponse{}}
+	for _, rule := range rules {
+		body.Rules = append(body.Rules, newEventRuleResponse(rule))
+	}
+
+	c.JSON(http.StatusOK, body)
+}
+
+// PutEventRule creates or replaces an event rule of the caller.
+func PutEventRule(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	input := EventRuleRequest{}
+	if err := json.NewDecoder(c.Request.Body).Decode(&input); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := compileEventPattern(input.Pattern); err != nil {
+		c.String(http.StatusBadRequest, "invalid pattern: %v", err)
+		return
+	}
+
+	if len(input.Targets) == 0 {
+		c.String(http.StatusBadRequest, "a rule needs at least one target")
+		return
+	}
+	for _, arn := range input.Targets {
+		targetID, err := parseTargetARN(arn)
+		if err == nil && !targetList.Exists(targetID) {
+			err = fmt.Errorf("target %s does not exist", arn)
+		}
+		if err == nil && !isRuleTargetAllowed(accountID, targetID) {
+			err = fmt.Errorf("target %s belongs to another account", arn)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	targets, _ := json.Marshal(input.Targets)
+
+	db := models.GetDB()
+	rule := models.EventRule{}
+	db.Where("account_id = ? AND name = ?", accountID, c.Param("name")).First(&rule)
+	rule.AccountID = accountID
+	rule.Name = c.Param("name")
+	rule.Pattern = string(input.Pattern)
+	rule.Targets = string(targets)
+	if err := db.Save(&rule).Error; err != nil {
+		log.Printf("saving rule %s of %s failed: %v", rule.Name, accountID, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, newEventRuleResponse(rule))
+}
+
+// DeleteEventRule removes an event rule of the caller.
+func DeleteEventRule(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	db := models.GetDB()
+	rule := models.EventRule{}
+	if db.Where("account_id = ? AND name = ?", accountID, c.Param("name")).First(&rule).RecordNotFound() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	db.Unscoped().Delete(&rule)
+	c.Status(http.StatusNoContent)
+}
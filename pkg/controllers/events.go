@@ -0,0 +1,523 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+// eventMatch is an object request whose event some targets are subscribed
+// to, or which event rules of the account are to be matched against.
+type eventMatch struct {
+	bucketName string
+	objectName string
+	targetIDs  event.TargetIDSet
+	configIDs  map[event.TargetID]string
+	rules      []*eventRule
+}
+
+// matchTargets returns the targets the rules of the bucket in req send
+// eventType to, or nil when there are none.
+func matchTargets(req *http.Request, eventType event.Name) *eventMatch {
+	bucketName, objectName, err := getObjectName(req)
+	if err != nil {
+		return nil
+	}
+
+	return matchObject(bucketName, objectName, eventType)
+}
+
+func matchObject(bucketName, objectName string, eventType event.Name) *eventMatch {
+	match := matchConfig(bucketName, objectName, eventType)
+
+	if rules := bucketAccountRules(bucketName, eventType); len(rules) > 0 {
+		if match == nil {
+			match = &eventMatch{bucketName: bucketName, objectName: objectName, targetIDs: event.NewTargetIDSet()}
+		}
+		match.rules = rules
+	}
+
+	if _, ok := replications.replicates(bucketName, objectName, eventType); ok && match == nil {
+		match = &eventMatch{bucketName: bucketName, objectName: objectName, targetIDs: event.NewTargetIDSet()}
+	}
+
+	return match
+}
+
+// matchConfig returns the targets the notification configuration stored
+// under configName sends the event of objectName to.
+func matchConfig(configName, objectName string, eventType event.Name) *eventMatch {
+	if !hasConfigRules(configName, eventType) {
+		return nil
+	}
+
+	notification, _ := bucketRules.get(configName)
+	targetIDs := notification.rules[eventType].Match(objectName)
+	if len(targetIDs) == 0 {
+		return nil
+	}
+
+	return &eventMatch{bucketName: configName, objectName: objectName, targetIDs: targetIDs, configIDs: notification.configIDs}
+}
+
+// hasRules reports whether any rule of bucket sends eventType, whether
+// the owner of bucket has event rules, or whether the bucket is replicated,
+// which lets requests skip work for events nobody is subscribed to.
+func hasRules(bucketName string, eventType event.Name) bool {
+	if hasConfigRules(bucketName, eventType) || len(bucketAccountRules(bucketName, eventType)) > 0 {
+		return true
+	}
+
+	return isObjectChange(eventType) && replications.get(bucketName) != nil
+}
+
+func hasConfigRules(bucketName string, eventType event.Name) bool {
+	notification, err := bucketRules.get(bucketName)
+	if err != nil {
+		log.Printf("reading notification config of %s failed: %v", bucketName, err)
+		return false
+	}
+
+	_, ok := notification.rules[eventType]
+	return ok
+}
+
+// uploadSize is the size of the object uploaded by req, which for signed
+// streaming uploads is not the size of the body.
+func uploadSize(req *http.Request) int64 {
+	if size, err := strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+		return size
+	}
+
+	return req.ContentLength
+}
+
+// statObject reads the metadata of an object back from RGW, for requests
+// which do not carry it themselves.
+func statObject(bucketName, objectName, versionID string) event.Object {
+	head, err := headObject(bucketName, objectName, versionID)
+	if err != nil {
+		log.Printf("reading metadata of %s/%s failed: %v", bucketName, objectName, err)
+		return event.Object{Key: eventKey(objectName), VersionID: versionID}
+	}
+
+	object := objectFromHeader(objectName, head.Header)
+	object.Size = head.ContentLength
+	return object
+}
+
+func sendEvent(resp *http.Response, eventType event.Name) error {
+	match := matchTargets(resp.Request, eventType)
+	if match == nil {
+		return nil
+	}
+
+	versionID := resp.Header.Get("X-Amz-Version-Id")
+
+	var object event.Object
+	switch eventType {
+	case event.ObjectCreatedPut:
+		// The content type and metadata are sent with the object, the ETag
+		// and version come back with the response.
+		object = objectFromHeader(match.objectName, resp.Request.Header)
+		object.Size = uploadSize(resp.Request)
+		object.ETag = strings.Trim(resp.Header.Get("Etag"), `"`)
+		object.VersionID = versionID
+	case event.ObjectCreatedCopy:
+		object = statObject(match.bucketName, match.objectName, versionID)
+	}
+
+	dispatchEvent(resp, eventType, match, object)
+	return nil
+}
+
+// sendAccessEvent reports a read of an object. The size is the one of the
+// whole object, also when only a range of it was read.
+func sendAccessEvent(resp *http.Response, eventType event.Name) error {
+	match := matchTargets(resp.Request, eventType)
+	if match == nil {
+		return nil
+	}
+
+	object := objectFromHeader(match.objectName, resp.Header)
+	object.Size = resp.ContentLength
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "" {
+		total := contentRange[strings.LastIndex(contentRange, "/")+1:]
+		if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+			object.Size = n
+		}
+	}
+
+	dispatchEvent(resp, eventType, match, object)
+	return nil
+}
+
+// sendCompleteMultipartUploadEvent reports a completed multipart upload.
+// The request carries only the part list, so the object is read back from
+// RGW.
+func sendCompleteMultipartUploadEvent(resp *http.Response) error {
+	match := matchTargets(resp.Request, event.ObjectCreatedCompleteMultipartUpload)
+	if match == nil {
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	// RGW may answer 200 with an Error document when completing fails.
+	result := CompleteMultipartUploadResult{}
+	if err := xml.Unmarshal(b, &result); err != nil {
+		return nil
+	}
+
+	object := statObject(match.bucketName, match.objectName, resp.Header.Get("X-Amz-Version-Id"))
+	if object.ETag == "" {
+		object.ETag = strings.Trim(result.ETag, `"`)
+	}
+
+	dispatchEvent(resp, event.ObjectCreatedCompleteMultipartUpload, match, object)
+	return nil
+}
+
+// sendDeleteEvent reports a deleted object. Deleting from a versioned
+// bucket without naming a version only adds a delete marker.
+func sendDeleteEvent(resp *http.Response) error {
+	eventType := event.ObjectRemovedDelete
+	if _, ok := resp.Request.URL.Query()["versionId"]; !ok && resp.Header.Get("X-Amz-Delete-Marker") == "true" {
+		eventType = event.ObjectRemovedDeleteMarkerCreated
+	}
+
+	match := matchTargets(resp.Request, eventType)
+	if match == nil {
+		return nil
+	}
+
+	dispatchEvent(resp, eventType, match, event.Object{
+		Key:       eventKey(match.objectName),
+		VersionID: resp.Header.Get("X-Amz-Version-Id"),
+	})
+
+	return nil
+}
+
+func hasRemovalRules(bucketName string) bool {
+	return hasRules(bucketName, event.ObjectRemovedDelete) || hasRules(bucketName, event.ObjectRemovedDeleteMarkerCreated)
+}
+
+// sendMultiObjectDeleteEvents reports each object a multi-object delete
+// removed. In quiet mode the result lists only the errors, so the deleted
+// objects are the requested ones which did not fail, and whether markers
+// were created depends on the versioning of the bucket.
+func sendMultiObjectDeleteEvents(resp *http.Response, requestBody []byte) error {
+	bucketName, _ := getBucketName(resp.Request)
+	if !hasRemovalRules(bucketName) {
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	result := DeleteResult{}
+	if err := xml.Unmarshal(b, &result); err != nil {
+		return nil
+	}
+
+	deleted := result.Deleted
+	if len(deleted) == 0 && len(requestBody) > 0 {
+		request := DeleteRequest{}
+		if err := xml.Unmarshal(requestBody, &request); err != nil {
+			return nil
+		}
+
+		failed := map[DeletedObject]bool{}
+		for _, e := range result.Errors {
+			failed[DeletedObject{Key: e.Key, VersionID: e.VersionID}] = true
+		}
+
+		versioned, err := isBucketVersioned(bucketName)
+		if err != nil {
+			log.Printf("reading versioning of %s failed: %v", bucketName, err)
+		}
+
+		for _, object := range request.Objects {
+			if !failed[object] {
+				object.DeleteMarker = versioned && object.VersionID == ""
+				deleted = append(deleted, object)
+			}
+		}
+	}
+
+	var r *eventRequest
+	for _, object := range deleted {
+		eventType := event.ObjectRemovedDelete
+		versionID := object.VersionID
+		if object.DeleteMarker && object.VersionID == "" {
+			eventType = event.ObjectRemovedDeleteMarkerCreated
+			versionID = object.DeleteMarkerVersionID
+		}
+
+		match := matchObject(bucketName, object.Key, eventType)
+		if match == nil {
+			continue
+		}
+
+		if r == nil {
+			r = newEventRequest(resp, bucketName)
+		}
+		r.dispatch(eventType, match, event.Object{
+			Key:       eventKey(object.Key),
+			VersionID: versionID,
+		})
+	}
+
+	return nil
+}
+
+// sendSubresourceEvent reports a change of the tags or the ACL of an
+// object.
+func sendSubresourceEvent(resp *http.Response, eventType event.Name) error {
+	match := matchTargets(resp.Request, eventType)
+	if match == nil {
+		return nil
+	}
+
+	dispatchEvent(resp, eventType, match, event.Object{
+		Key:       eventKey(match.objectName),
+		VersionID: resp.Header.Get("X-Amz-Version-Id"),
+	})
+
+	return nil
+}
+
+// sendBucketEvent reports a created or removed bucket to the rules of the
+// account of the requester. The configuration of a removed bucket may ask
+// for its removal too, and is dropped along with the bucket.
+func sendBucketEvent(resp *http.Response, eventType event.Name) error {
+	bucketName, _ := getBucketName(resp.Request)
+	if eventType == event.BucketRemoved {
+		defer func() {
+			client := models.GetCache()
+			client.Del(fmt.Sprintf("config:%s", bucketName))
+			invalidateBucketRules(bucketName)
+		}()
+	}
+
+	principal := requestPrincipal(resp.Request)
+	if accountRules.hasRules(principal) {
+		// Every process indexes the buckets of the account again.
+		client := models.GetCache()
+		if err := client.Publish(models.EventRuleChannel, principal).Err(); err != nil {
+			log.Printf("announcing buckets of %s failed: %v", principal, err)
+		}
+	}
+
+	configNames := []string{accountConfigName(principal)}
+	if eventType == event.BucketRemoved {
+		configNames = append(configNames, bucketName)
+	}
+
+	match := &eventMatch{
+		bucketName: bucketName,
+		targetIDs:  event.NewTargetIDSet(),
+		configIDs:  map[event.TargetID]string{},
+		rules:      accountRules.get(principal, eventType),
+	}
+	for _, name := range configNames {
+		m := matchConfig(name, bucketName, eventType)
+		if m == nil {
+			continue
+		}
+
+		for targetID := range m.targetIDs {
+			if _, ok := match.targetIDs[targetID]; !ok {
+				match.targetIDs[targetID] = struct{}{}
+				match.configIDs[targetID] = m.configIDs[targetID]
+			}
+		}
+	}
+
+	if len(match.targetIDs) == 0 && len(match.rules) == 0 {
+		return nil
+	}
+
+	r := newEventRequestBy(resp, bucketName, principal)
+	if r.owner == "" {
+		r.owner = principal
+	}
+	r.dispatch(eventType, match, event.Object{})
+
+	return nil
+}
+
+// requestPrincipal is the user who signed req, or empty for anonymous
+// requests. The signature of a proxied request is verified once, however
+// many events it causes.
+func requestPrincipal(req *http.Request) string {
+	auth, ok := req.Context().Value(principalKey{}).(*requestAuth)
+	if !ok {
+		auth = &requestAuth{}
+	}
+
+	auth.once.Do(func() {
+		if userID, errCode := authenticate(req); errCode == cmd.ErrNone {
+			auth.principal = userID
+		}
+	})
+
+	return auth.principal
+}
+
+// eventRequest is what the events caused by one request have in common.
+// Events read from the logs of RGW are logged, and have no request.
+type eventRequest struct {
+	logged           bool
+	principal        string
+	owner            string
+	host             string
+	port             string
+	userAgent        string
+	responseElements map[string]string
+}
+
+func newEventRequest(resp *http.Response, bucketName string) *eventRequest {
+	return newEventRequestBy(resp, bucketName, requestPrincipal(resp.Request))
+}
+
+func newEventRequestBy(resp *http.Response, bucketName, principal string) *eventRequest {
+	clientReq := resp.Request
+	r := &eventRequest{
+		principal:        principal,
+		userAgent:        clientReq.UserAgent(),
+		responseElements: map[string]string{},
+	}
+
+	owner, err := getBucketOwner(bucketName)
+	if err != nil {
+		log.Printf("reading owner of %s failed: %v", bucketName, err)
+	}
+	r.owner = owner
+
+	r.host, r.port, err = net.SplitHostPort(clientReq.RemoteAddr)
+	if err != nil {
+		r.host = clientReq.RemoteAddr
+	}
+
+	if requestID := resp.Header.Get("X-Amz-Request-Id"); requestID != "" {
+		r.responseElements["x-amz-request-id"] = requestID
+	}
+	if hostID := resp.Header.Get("X-Amz-Id-2"); hostID != "" {
+		r.responseElements["x-amz-id-2"] = hostID
+	}
+
+	return r
+}
+
+func dispatchEvent(resp *http.Response, eventType event.Name, match *eventMatch, object event.Object) {
+	newEventRequest(resp, match.bucketName).dispatch(eventType, match, object)
+}
+
+func (r *eventRequest) dispatch(eventType event.Name, match *eventMatch, object event.Object) {
+	serverConfig := config.GetServerConfig()
+	eventTime := time.Now().UTC()
+	object.Sequencer = fmt.Sprintf("%X", eventTime.UnixNano())
+
+	newEvent := event.Event{
+		EventVersion: "2.0",
+		EventSource:  "aws:s3",
+		AwsRegion:    serverConfig.Region,
+		EventTime:    eventTime.Format(event.AMZTimeFormat),
+		EventName:    eventType,
+		UserIdentity: event.Identity{
+			PrincipalID: r.principal,
+		},
+		RequestParameters: map[string]string{
+			"sourceIPAddress": r.host,
+		},
+		ResponseElements: r.responseElements,
+		S3: event.Metadata{
+			SchemaVersion: "1.0",
+			Bucket: event.Bucket{
+				Name: match.bucketName,
+				OwnerIdentity: event.Identity{
+					PrincipalID: r.owner,
+				},
+				ARN: "arn:aws:s3:::" + match.bucketName,
+			},
+			Object: object,
+		},
+		Source: event.Source{
+			Host:      r.host,
+			Port:      r.port,
+			UserAgent: r.userAgent,
+		},
+	}
+
+	if !r.logged {
+		markProxied(match.bucketName, object.Key, eventType)
+	}
+
+	// Targets of the notification configuration get the event first, the
+	// event rules add the targets not sent to yet, named by the rule.
+	configIDs := map[event.TargetID]string{}
+	for targetID := range match.targetIDs {
+		configIDs[targetID] = match.configIDs[targetID]
+	}
+	if len(match.rules) > 0 {
+		for targetID, ruleName := range matchEventRules(match.rules, newEvent) {
+			if _, ok := configIDs[targetID]; !ok {
+				configIDs[targetID] = ruleName
+			}
+		}
+	}
+
+	if t, ok := replications.replicates(match.bucketName, match.objectName, eventType); ok {
+		configIDs[t.id] = replicationConfigID
+		markReplicationPending(match.bucketName, match.objectName)
+	}
+
+	for targetID, configID := range configIDs {
+		if !targetList.Exists(targetID) {
+			continue
+		}
+
+		newEvent.S3.ConfigurationID = configID
+		if err := enqueueEvent(targetID, newEvent); err != nil {
+			log.Printf("queueing event for %s failed: %v", targetID, err)
+		}
+	}
+}
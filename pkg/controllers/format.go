@@ -0,0 +1,271 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/minio/minio/pkg/event"
+)
+
+// Payload formats bucket events can be delivered in. Targets without one
+// keep the payload they always had.
+const (
+	s3Payload                = "s3"
+	cloudEventsPayload       = "cloudevents"
+	cloudEventsBinaryPayload = "cloudevents-binary"
+	eventBridgePayload       = "eventbridge"
+)
+
+// validatePayloadFormat checks that format can be delivered to a target.
+// The binary mode of CloudEvents carries its attributes in HTTP headers, so
+// only webhooks take it.
+func validatePayloadFormat(format string, overHTTP bool) error {
+	switch format {
+	case "", s3Payload, cloudEventsPayload, eventBridgePayload:
+		return nil
+	case cloudEventsBinaryPayload:
+		if overHTTP {
+			return nil
+		}
+		return fmt.Errorf("%s is only supported by webhooks", format)
+	}
+
+	return fmt.Errorf("unknown payload format %s", format)
+}
+
+// eventPayload is a bucket event serialized for a target, with the headers
+// to send it with when the target is reached over HTTP.
+type eventPayload struct {
+	header http.Header
+	body   []byte
+}
+
+type s3Records struct {
+	Records []event.Event
+}
+
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            event.Event `json:"data"`
+}
+
+type eventBridgeEvent struct {
+	Version    string            `json:"version"`
+	ID         string            `json:"id"`
+	DetailType string            `json:"detail-type"`
+	Source     string            `json:"source"`
+	Account    string            `json:"account"`
+	Time       string            `json:"time"`
+	Region     string            `json:"region"`
+	Resources  []string          `json:"resources"`
+	Detail     eventBridgeDetail `json:"detail"`
+}
+
+type eventBridgeBucket struct {
+	Name string `json:"name"`
+}
+
+type eventBridgeObject struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size,omitempty"`
+	ETag      string `json:"etag,omitempty"`
+	VersionID string `json:"version-id,omitempty"`
+	Sequencer string `json:"sequencer,omitempty"`
+}
+
+type eventBridgeDetail struct {
+	Version         string             `json:"version"`
+	Bucket          eventBridgeBucket  `json:"bucket"`
+	Object          *eventBridgeObject `json:"object,omitempty"`
+	RequestID       string             `json:"request-id"`
+	Requester       string             `json:"requester"`
+	SourceIPAddress string             `json:"source-ip-address,omitempty"`
+	Reason          string             `json:"reason,omitempty"`
+	DeletionType    string             `json:"deletion-type,omitempty"`
+	Replay          bool               `json:"replay,omitempty"`
+}
+
+// eventID identifies a bucket event in the formats that need an id. It is
+// derived from the event, so a replayed event keeps its id.
+func eventID(e event.Event) string {
+	sum := sha1.Sum([]byte(strings.Join([]string{
+		e.ResponseElements["x-amz-request-id"],
+		e.EventName.String(),
+		e.S3.Bucket.Name,
+		e.S3.Object.Key,
+		e.S3.Object.VersionID,
+		e.S3.Object.Sequencer,
+	}, "\n")))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func cloudEventType(name event.Name) string {
+	return "com.amazonaws.s3." + strings.TrimPrefix(name.String(), "s3:")
+}
+
+func newCloudEvent(e event.Event) cloudEvent {
+	subject := e.S3.Object.Key
+	if key, err := url.QueryUnescape(subject); err == nil {
+		subject = key
+	}
+
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              eventID(e),
+		Source:          e.S3.Bucket.ARN,
+		Type:            cloudEventType(e.EventName),
+		Subject:         subject,
+		Time:            e.EventTime,
+		DataContentType: "application/json",
+		Data:            e,
+	}
+}
+
+// eventBridgeDetailTypes names the S3 events like EventBridge does, with
+// the reason or deletion type of the detail.
+var eventBridgeDetailTypes = map[event.Name][2]string{
+	event.ObjectCreatedPut:                     {"Object Created", "PutObject"},
+	event.ObjectCreatedPost:                    {"Object Created", "PostObject"},
+	event.ObjectCreatedCopy:                    {"Object Created", "CopyObject"},
+	event.ObjectCreatedCompleteMultipartUpload: {"Object Created", "CompleteMultipartUpload"},
+	event.ObjectRemovedDelete:                  {"Object Deleted", "Permanently Deleted"},
+	event.ObjectRemovedDeleteMarkerCreated:     {"Object Deleted", "Delete Marker Created"},
+	event.ObjectAccessedGet:                    {"Object Accessed", "GetObject"},
+	event.ObjectAccessedHead:                   {"Object Accessed", "HeadObject"},
+	event.ObjectTaggingPut:                     {"Object Tags Added", "PutObjectTagging"},
+	event.ObjectTaggingDelete:                  {"Object Tags Deleted", "DeleteObjectTagging"},
+	event.ObjectAclPut:                         {"Object ACL Updated", "PutObjectAcl"},
+	event.BucketCreated:                        {"Bucket Created", "CreateBucket"},
+	event.BucketRemoved:                        {"Bucket Deleted", "DeleteBucket"},
+}
+
+func newEventBridgeEvent(e event.Event) eventBridgeEvent {
+	detailType := eventBridgeDetailTypes[e.EventName]
+
+	detail := eventBridgeDetail{
+		Version:         "0",
+		Bucket:          eventBridgeBucket{Name: e.S3.Bucket.Name},
+		RequestID:       e.ResponseElements["x-amz-request-id"],
+		Requester:       e.UserIdentity.PrincipalID,
+		SourceIPAddress: e.RequestParameters["sourceIPAddress"],
+		Replay:          e.Replay,
+	}
+	if e.EventName.IsRemoval() {
+		detail.Reason = "DeleteObject"
+		detail.DeletionType = detailType[1]
+	} else {
+		detail.Reason = detailType[1]
+	}
+
+	if !e.EventName.IsBucketEvent() {
+		key := e.S3.Object.Key
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+
+		detail.Object = &eventBridgeObject{
+			Key:       key,
+			Size:      e.S3.Object.Size,
+			ETag:      e.S3.Object.ETag,
+			VersionID: e.S3.Object.VersionID,
+			Sequencer: e.S3.Object.Sequencer,
+		}
+	}
+
+	return eventBridgeEvent{
+		Version:    "0",
+		ID:         eventID(e),
+		DetailType: detailType[0],
+		Source:     "aws.s3",
+		Account:    e.S3.Bucket.OwnerIdentity.PrincipalID,
+		Time:       e.EventTime,
+		Region:     e.AwsRegion,
+		Resources:  []string{e.S3.Bucket.ARN},
+		Detail:     detail,
+	}
+}
+
+// formatEvent serializes a bucket event in format. Without a format the
+// event record is sent on its own.
+func formatEvent(format string, e event.Event) (eventPayload, error) {
+	payload := eventPayload{header: http.Header{}}
+	payload.header.Set("Content-Type", "application/json")
+
+	var v interface{}
+	switch format {
+	case "":
+		v = e
+	case s3Payload:
+		v = s3Records{Records: []event.Event{e}}
+	case cloudEventsPayload:
+		payload.header.Set("Content-Type", "application/cloudevents+json")
+		v = newCloudEvent(e)
+	case cloudEventsBinaryPayload:
+		ce := newCloudEvent(e)
+		payload.header.Set("Ce-Specversion", ce.SpecVersion)
+		payload.header.Set("Ce-Id", ceHeaderValue(ce.ID))
+		payload.header.Set("Ce-Source", ceHeaderValue(ce.Source))
+		payload.header.Set("Ce-Type", ceHeaderValue(ce.Type))
+		payload.header.Set("Ce-Time", ce.Time)
+		if ce.Subject != "" {
+			payload.header.Set("Ce-Subject", ceHeaderValue(ce.Subject))
+		}
+		v = e
+	case eventBridgePayload:
+		v = newEventBridgeEvent(e)
+	default:
+		return payload, fmt.Errorf("unknown payload format %s", format)
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return payload, err
+	}
+	payload.body = body
+
+	return payload, nil
+}
+
+// ceHeaderValue percent-encodes an attribute for a header of the binary
+// mode of CloudEvents, as its HTTP binding asks for everything but the
+// printable ASCII characters other than space, '"' and '%'.
+func ceHeaderValue(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c > '~' || c == '"' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
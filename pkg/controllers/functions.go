@@ -0,0 +1,335 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+const (
+	functionService            = "lambda"
+	functionWorkers            = 32
+	defaultFunctionTimeout     = 3
+	maxFunctionTimeout         = 900
+	defaultFunctionConcurrency = 10
+	maxInvocationsListed       = 1000
+)
+
+func functionTargetID(accountID, name string) event.TargetID {
+	return event.TargetID{Service: functionService, ID: accountID, Name: name}
+}
+
+// parseFunctionARN reads arn:aws:lambda:<region>:<account>:function:<name>.
+func parseFunctionARN(arn string) (event.TargetID, error) {
+	tokens := strings.Split(arn, ":")
+	if len(tokens) != 7 || tokens[0] != "arn" || tokens[1] != "aws" || tokens[2] != "lambda" ||
+		tokens[4] == "" || tokens[5] != "function" || tokens[6] == "" {
+		return event.TargetID{}, &event.ErrInvalidARN{ARN: arn}
+	}
+
+	return functionTargetID(tokens[4], tokens[6]), nil
+}
+
+// functionTarget invokes a function with each event and waits for its
+// result. Invocations beyond its concurrency wait for a free slot as long
+// as the timeout, and are retried later when none frees up.
+type functionTarget struct {
+	id         event.TargetID
+	url        string
+	authHeader string
+	timeout    time.Duration
+	slots      chan struct{}
+	client     *http.Client
+}
+
+func newFunctionTarget(f models.Function) *functionTarget {
+	timeout := time.Duration(f.Timeout) * time.Second
+
+	return &functionTarget{
+		id:         functionTargetID(f.AccountID, f.Name),
+		url:        f.URL,
+		authHeader: f.AuthHeader,
+		timeout:    timeout,
+		slots:      make(chan struct{}, f.Concurrency),
+		client:     &http.Client{Timeout: timeout},
+	}
+}
+
+func (t *functionTarget) ID() event.TargetID {
+	return t.id
+}
+
+func (t *functionTarget) Send(e event.Event) error {
+	invocation := models.FunctionInvocation{
+		AccountID: t.id.ID,
+		Function:  t.id.Name,
+		EventName: e.EventName.String(),
+		Bucket:    e.S3.Bucket.Name,
+		Key:       e.S3.Object.Key,
+	}
+
+	err := t.invoke(e, &invocation)
+	if err != nil {
+		invocation.Error = err.Error()
+	}
+
+	db := models.GetDB()
+	if dbErr := db.Create(&invocation).Error; dbErr != nil {
+		log.Printf("recording invocation of %s failed: %v", t.id, dbErr)
+	}
+
+	return err
+}
+
+func (t *functionTarget) invoke(e event.Event, invocation *models.FunctionInvocation) error {
+	select {
+	case t.slots <- struct{}{}:
+	case <-time.After(t.timeout):
+		invocation.Status = models.InvocationThrottled
+		return errors.New("concurrency limit reached")
+	}
+	defer func() { <-t.slots }()
+
+	payload, err := formatEvent(s3Payload, e)
+	if err != nil {
+		invocation.Status = models.InvocationFailed
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(payload.body))
+	if err != nil {
+		invocation.Status = models.InvocationFailed
+		return err
+	}
+	req.Header = payload.header
+	req.Header.Set("X-Amz-Invocation-Type", "RequestResponse")
+	if t.authHeader != "" {
+		req.Header.Set("Authorization", t.authHeader)
+	}
+
+	start := time.Now()
+	resp, err := t.client.Do(req)
+	invocation.Duration = time.Since(start)
+	if err != nil {
+		invocation.Status = models.InvocationFailed
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			invocation.Status = models.InvocationTimedOut
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	invocation.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		invocation.Status = models.InvocationFailed
+		return fmt.Errorf("function responded with %s", resp.Status)
+	}
+
+	invocation.Status = models.InvocationSucceeded
+	return nil
+}
+
+func (t *functionTarget) Close() error {
+	return nil
+}
+
+func addFunctionTarget(f models.Function) {
+	id := functionTargetID(f.AccountID, f.Name)
+	if version, ok := targetVersions[id]; ok && version.Equal(f.UpdatedAt) {
+		return
+	}
+
+	removeTargets(id)
+	targetList.Add(newFunctionTarget(f))
+	targetVersions[id] = f.UpdatedAt
+}
+
+func applyFunctionChange(payload string) {
+	tokens := strings.SplitN(payload, ":", 2)
+	if len(tokens) != 2 {
+		log.Printf("invalid function change %q", payload)
+		return
+	}
+
+	db := models.GetDB()
+	f := models.Function{}
+	if db.Where("account_id = ? AND name = ?", tokens[0], tokens[1]).First(&f).RecordNotFound() {
+		removeRegisteredTarget(functionTargetID(tokens[0], tokens[1]))
+		return
+	}
+
+	addFunctionTarget(f)
+}
+
+func newFunctionResponse(f models.Function) FunctionResponse {
+	return FunctionResponse{
+		ARN:         f.ARN(),
+		URL:         f.URL,
+		Timeout:     f.Timeout,
+		Concurrency: f.Concurrency,
+	}
+}
+
+// ListFunctions lists the registered functions. Auth headers are never
+// returned.
+func ListFunctions(c *gin.Context) {
+	if !authenticateAdmin(c) {
+		return
+	}
+
+	db := models.GetDB()
+	functions := []models.Function{}
+	db.Order("account_id, name").Find(&functions)
+
+	body := FunctionsResponse{Functions: []FunctionResponse{}}
+	for _, f := range functions {
+		body.Functions = append(body.Functions, newFunctionResponse(f))
+	}
+
+	c.JSON(http.StatusOK, body)
+}
+
+// PutFunction registers a function of an account, or changes one.
+func PutFunction(c *gin.Context) {
+	if !authenticateAdmin(c) {
+		return
+	}
+
+	accountID, name := c.Param("account"), c.Param("name")
+	if strings.Contains(accountID, ":") || strings.ContainsAny(name, ":/") {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	input := FunctionRequest{}
+	if err := json.NewDecoder(c.Request.Body).Decode(&input); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(input.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.String(http.StatusBadRequest, "url must be an http or https URL")
+		return
+	}
+	if input.Timeout == 0 {
+		input.Timeout = defaultFunctionTimeout
+	}
+	if input.Timeout < 0 || input.Timeout > maxFunctionTimeout {
+		c.String(http.StatusBadRequest, "timeout must be between 1 and %d seconds", maxFunctionTimeout)
+		return
+	}
+	if input.Concurrency == 0 {
+		input.Concurrency = defaultFunctionConcurrency
+	}
+	if input.Concurrency < 0 {
+		c.String(http.StatusBadRequest, "concurrency must be positive")
+		return
+	}
+
+	db := models.GetDB()
+	f := models.Function{}
+	db.Where("account_id = ? AND name = ?", accountID, name).First(&f)
+	f.AccountID = accountID
+	f.Name = name
+	f.URL = input.URL
+	f.AuthHeader = input.AuthHeader
+	f.Timeout = input.Timeout
+	f.Concurrency = input.Concurrency
+	if err := db.Save(&f).Error; err != nil {
+		log.Printf("saving function %s failed: %v", f.ARN(), err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, newFunctionResponse(f))
+}
+
+// DeleteFunction removes a function. Its invocations are kept until they
+// expire with the event log.
+func DeleteFunction(c *gin.Context) {
+	if !authenticateAdmin(c) {
+		return
+	}
+
+	db := models.GetDB()
+	f := models.Function{}
+	if db.Where("account_id = ? AND name = ?", c.Param("account"), c.Param("name")).First(&f).RecordNotFound() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	db.Unscoped().Delete(&f)
+	c.Status(http.StatusNoContent)
+}
+
+// ListFunctionInvocations lists the latest invocations of a function to
+// administrators and to the account of the function.
+func ListFunctionInvocations(c *gin.Context) {
+	callerID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	accountID, name := c.Param("account"), c.Param("name")
+	if callerID != accountID && !config.GetServerConfig().IsAdmin(callerID) {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > maxInvocationsListed {
+		limit = maxInvocationsListed
+	}
+
+	db := models.GetDB()
+	invocations := []models.FunctionInvocation{}
+	db.Where("account_id = ? AND function = ?", accountID, name).Order("id desc").Limit(limit).Find(&invocations)
+
+	body := FunctionInvocationsResponse{Invocations: []FunctionInvocation{}}
+	for _, invocation := range invocations {
+		body.Invocations = append(body.Invocations, FunctionInvocation{
+			ID:         invocation.ID,
+			EventName:  invocation.EventName,
+			Bucket:     invocation.Bucket,
+			Key:        invocation.Key,
+			Status:     invocation.Status,
+			StatusCode: invocation.StatusCode,
+			Duration:   invocation.Duration.Seconds() * 1000,
+			Error:      invocation.Error,
+			InvokedAt:  invocation.CreatedAt.UTC().Format(event.AMZTimeFormat),
+		})
+	}
+
+	c.JSON(http.StatusOK, body)
+}
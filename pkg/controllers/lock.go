@@ -0,0 +1,58 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+// renewLockScript extends a lock only if it is still held by the caller.
+const renewLockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`
+
+// releaseLockScript deletes a lock only if it is still held by the caller.
+const releaseLockScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+// redisLock is held by one owner at a time, across processes, until it is
+// released or its ttl passes without being renewed.
+type redisLock struct {
+	key   string
+	owner string
+	ttl   time.Duration
+}
+
+func (l *redisLock) acquire() (bool, error) {
+	return models.GetCache().SetNX(l.key, l.owner, l.ttl).Result()
+}
+
+func (l *redisLock) renew() (bool, error) {
+	n, err := models.GetCache().Eval(renewLockScript, []string{l.key}, l.owner, int64(l.ttl/time.Millisecond)).Result()
+	return n == int64(1), err
+}
+
+func (l *redisLock) release() error {
+	return models.GetCache().Eval(releaseLockScript, []string{l.key}, l.owner).Err()
+}
@@ -16,38 +16,50 @@ package controllers
 
 import (
 	"bytes"
-	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
 	"github.com/minio/minio/cmd"
 	"github.com/minio/minio/pkg/event"
 	"github.com/inwinstack/kaoliang/pkg/config"
 	"github.com/inwinstack/kaoliang/pkg/models"
-	"github.com/inwinstack/kaoliang/pkg/utils"
 )
 
-var targetList *event.TargetList
 var errNoSuchNotifications = errors.New("The specified bucket does not have bucket notifications")
 
-func GetBucketNotification(c *gin.Context) {
-	_, err := authenticate(c.Request)
-	if err != cmd.ErrNone {
-		writeErrorResponse(c, err)
-	}
+// accountConfigName names the notification configuration of an account,
+// requested on the service itself. It holds the rules for bucket events,
+// whose filters apply to bucket names.
+func accountConfigName(accountID string) string {
+	return "account:" + accountID
+}
 
-	bucket := c.Param("bucket")
+func GetBucketNotification(c *gin.Context) {
+	bucket, _ := getBucketName(c.Request)
 
 	_, notification := c.GetQuery("notification")
 
 	if notification {
+		accountID, errCode := authenticate(c.Request)
+		if errCode != cmd.ErrNone {
+			writeErrorResponse(c, errCode)
+			return
+		}
+
+		if bucket == "" {
+			bucket = accountConfigName(accountID)
+		}
+
 		nConfig, err := readNotificationConfig(targetList, bucket)
 		if err != nil {
 			if err != errNoSuchNotifications {
@@ -66,20 +78,25 @@ func GetBucketNotification(c *gin.Context) {
 }
 
 func PutBucketNotification(c *gin.Context) {
-	_, err := authenticate(c.Request)
-	if err != cmd.ErrNone {
-		writeErrorResponse(c, err)
-	}
-
-	bucket := c.Param("bucket")
+	bucket, _ := getBucketName(c.Request)
 	serverConfig := config.GetServerConfig()
 
 	_, notification := c.GetQuery("notification")
 
 	if notification {
+		accountID, errCode := authenticate(c.Request)
+		if errCode != cmd.ErrNone {
+			writeErrorResponse(c, errCode)
+			return
+		}
+
 		region := serverConfig.Region
 
 		config, err := event.ParseConfig(c.Request.Body, region, targetList)
+		if err == nil && bucket == "" {
+			bucket = accountConfigName(accountID)
+			err = validateAccountConfig(config)
+		}
 		if err != nil {
 			apiErr := cmd.ErrMalformedXML
 			if event.IsEventError(err) {
@@ -90,6 +107,39 @@ func PutBucketNotification(c *gin.Context) {
 			return
 		}
 
+		// Only the owner of a bucket configures its notifications. Functions
+		// are invoked on its behalf, so it may only name its own.
+		owner := accountID
+		if bucket != accountConfigName(accountID) {
+			if owner, err = getBucketOwner(bucket); err != nil {
+				writeErrorResponse(c, cmd.ToAPIErrorCode(err))
+				return
+			}
+		}
+		if owner != accountID {
+			writeErrorResponse(c, cmd.ErrAccessDenied)
+			return
+		}
+		for _, lambda := range config.LambdaList {
+			if lambda.ARN.TargetID.ID != owner {
+				writeErrorResponse(c, cmd.ErrAccessDenied)
+				return
+			}
+		}
+
+		// Events are published to topics on behalf of the owner of the
+		// bucket too, which needs the permission of the topic to do so.
+		db := models.GetDB()
+		for _, topicConfig := range config.TopicList {
+			targetID := topicConfig.ARN.TargetID
+			topic := models.Resource{}
+			if db.Where(models.Resource{Service: models.SNS, AccountID: targetID.ID, Name: targetID.Name}).First(&topic).RecordNotFound() ||
+				!isTopicActionAllowed(owner, topic, "Publish") {
+				writeErrorResponse(c, cmd.ErrAccessDenied)
+				return
+			}
+		}
+
 		if err = saveNotificationConfig(config, bucket); err != nil {
 			writeErrorResponse(c, cmd.ToAPIErrorCode(err))
 			return
@@ -102,32 +152,113 @@ func PutBucketNotification(c *gin.Context) {
 	ReverseProxy()(c)
 }
 
+// validateAccountConfig allows only bucket events in the configuration of
+// an account.
+func validateAccountConfig(conf *event.Config) error {
+	var names []event.Name
+	for _, queue := range conf.QueueList {
+		names = append(names, queue.Events...)
+	}
+	for _, topic := range conf.TopicList {
+		names = append(names, topic.Events...)
+	}
+	for _, lambda := range conf.LambdaList {
+		names = append(names, lambda.Events...)
+	}
+
+	for _, name := range names {
+		if !name.IsBucketEvent() {
+			return &event.ErrInvalidEventName{Name: name.String()}
+		}
+	}
+
+	return nil
+}
+
 func readNotificationConfig(targetList *event.TargetList, bucket string) (*event.Config, error) {
 	client := models.GetCache()
+	serverConfig := config.GetServerConfig()
 	val, err := client.Get(fmt.Sprintf("config:%s", bucket)).Result()
-	if err != nil {
+	if err == redis.Nil {
 		return nil, errNoSuchNotifications
+	} else if err != nil {
+		return nil, err
 	}
 
-	config, err := event.ParseConfig(strings.NewReader(val), "us-east-1", targetList)
+	// The config was validated when it was put. Queues and topics deleted
+	// since are left in it and skipped when events are sent.
+	config := event.Config{}
+	if err := xml.Unmarshal([]byte(val), &config); err != nil {
+		return nil, err
+	}
+	config.SetRegion(serverConfig.Region)
 
-	return config, err
+	return &config, nil
 }
 
 func saveNotificationConfig(conf *event.Config, bucket string) error {
 	output, err := xml.Marshal(conf)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	client := models.GetCache()
 	if err := client.Set(fmt.Sprintf("config:%s", bucket), output, 0).Err(); err != nil {
-		return nil
+		return err
 	}
 
+	invalidateBucketRules(bucket)
 	return nil
 }
 
+// isMultipartRequest reports whether req belongs to a multipart upload, i.e.
+// uploads or copies a part, completes or aborts the upload.
+func isMultipartRequest(req *http.Request) bool {
+	_, ok := req.URL.Query()["uploadId"]
+	return ok
+}
+
+// objectSubresources are queried with GET or HEAD on an object without
+// reading the object itself.
+var objectSubresources = []string{"acl", "tagging", "torrent", "retention", "legal-hold", "uploadId"}
+
+func isObjectRead(resp *http.Response, method string) bool {
+	clientReq := resp.Request
+	if clientReq.Method != method || (resp.StatusCode != 200 && resp.StatusCode != 206) {
+		return false
+	}
+
+	query := clientReq.URL.Query()
+	for _, subresource := range objectSubresources {
+		if _, ok := query[subresource]; ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isObjectSubresource(req *http.Request, subresource string) bool {
+	if _, ok := req.URL.Query()[subresource]; !ok {
+		return false
+	}
+
+	_, _, err := getObjectName(req)
+	return err == nil
+}
+
+// isBucketRequest reports whether req creates or deletes a bucket rather
+// than one of its subresources.
+func isBucketRequest(req *http.Request) bool {
+	bucketName, objectName := getBucketName(req)
+	return bucketName != "" && objectName == "" && req.URL.RawQuery == ""
+}
+
+func isMultiObjectDelete(req *http.Request) bool {
+	_, ok := req.URL.Query()["delete"]
+	return req.Method == "POST" && ok
+}
+
 func checkResponse(resp *http.Response, method string, statusCode int) bool {
 	clientReq := resp.Request
 
@@ -138,78 +269,90 @@ func checkResponse(resp *http.Response, method string, statusCode int) bool {
 	return false
 }
 
-// currently only supports path-style syntax
+// getBucketName resolves the bucket of a virtual-hosted-style request from
+// its host, a subdomain of RGW_DNS_NAME, and falls back to path-style.
+func getBucketName(req *http.Request) (string, string) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	suffix := "." + config.GetServerConfig().Host
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+		return strings.TrimSuffix(host, suffix), path
+	}
+
+	segments := strings.SplitN(path, "/", 2)
+	if len(segments) < 2 {
+		return segments[0], ""
+	}
+
+	return segments[0], segments[1]
+}
+
+// getObjectName returns the bucket and the decoded key of an object request.
 func getObjectName(req *http.Request) (string, string, error) {
-	segments := strings.Split(req.URL.Path, "/")
-	bucketName := segments[1]
-	objectName := segments[2]
+	bucketName, objectName := getBucketName(req)
+	if bucketName == "" || objectName == "" {
+		return "", "", fmt.Errorf("%s is not an object request", req.URL.Path)
+	}
 
 	return bucketName, objectName, nil
 }
 
-func sendEvent(resp *http.Response, eventType event.Name) error {
-	clientReq := resp.Request
-	bucketName, objectName, _ := getObjectName(clientReq)
+// eventKey encodes an object key the way S3 does in event records.
+func eventKey(objectName string) string {
+	return strings.Replace(url.QueryEscape(objectName), "%2F", "/", -1)
+}
+
+func sendToTarget(targetID event.TargetID, format string, newEvent event.Event) error {
+	if targetID.Service == models.SNS.String() {
+		return publishToTopic(targetID, newEvent)
+	}
+
+	payload, err := formatEvent(format, newEvent)
+	if err != nil {
+		return err
+	}
 
 	client := models.GetCache()
-	serverConfig := config.GetServerConfig()
-	nConfig, err := readNotificationConfig(targetList, bucketName)
+	return client.RPush(fmt.Sprintf("%s:%s:%s", targetID.Service, targetID.ID, targetID.Name), payload.body).Err()
+}
+
+// publishToTopic fans a bucket event out to the subscriptions of a topic,
+// with the event records as the message like S3 does.
+func publishToTopic(targetID event.TargetID, newEvent event.Event) error {
+	db := models.GetDB()
+	topic := models.Resource{}
+	if db.Where(models.Resource{Service: models.SNS, AccountID: targetID.ID, Name: targetID.Name}).First(&topic).RecordNotFound() {
+		return fmt.Errorf("topic %s does not exist", targetID)
+	}
+
+	format := topic.PayloadFormat
+	if format == "" {
+		format = s3Payload
+	}
+
+	payload, err := formatEvent(format, newEvent)
 	if err != nil {
-		panic(err)
-	}
-
-	rulesMap := nConfig.ToRulesMap()
-	eventTime := time.Now().UTC()
-
-	var etag string
-	if val, ok := resp.Header["Etag"]; ok {
-		etag = val[0]
-	}
-
-	for targetID := range rulesMap[eventType].Match(objectName) {
-		newEvent := event.Event{
-			EventVersion: "2.0",
-			EventSource:  "aws:s3",
-			AwsRegion:    serverConfig.Region,
-			EventTime:    eventTime.Format("2006-01-02T15:04:05Z"),
-			EventName:    eventType,
-			UserIdentity: event.Identity{
-				PrincipalID: "",
-			},
-			RequestParameters: map[string]string{
-				"sourceIPAddress": clientReq.RemoteAddr,
-			},
-			ResponseElements: map[string]string{
-				"x-amz-request-id": resp.Header["X-Amz-Request-Id"][0],
-			},
-			S3: event.Metadata{
-				SchemaVersion:   "1.0",
-				ConfigurationID: "Config",
-				Bucket: event.Bucket{
-					Name: bucketName,
-					OwnerIdentity: event.Identity{
-						PrincipalID: "",
-					},
-					ARN: "",
-				},
-				Object: event.Object{
-					Key:       objectName,
-					Size:      clientReq.ContentLength,
-					ETag:      etag,
-					Sequencer: fmt.Sprintf("%X", eventTime.UnixNano()),
-				},
-			},
-		}
-
-		value, err := json.Marshal(newEvent)
-		if err != nil {
-			panic(err)
-		}
+		return err
+	}
+
+	input := publishInput{
+		Subject: "Amazon S3 Notification",
+		Message: string(payload.body),
+	}
+	if topic.IsFIFO() {
+		input.MessageGroupID = newEvent.S3.Bucket.Name
+		input.MessageDeduplicationID = newEvent.S3.Object.Sequencer
+	}
 
-		client.RPush(fmt.Sprintf("%s:%s:%s", targetID.Service, targetID.ID, targetID.Name), value)
+	if _, _, publishErr := publishMessage(topic, input); publishErr != nil {
+		return errors.New(publishErr.Message)
 	}
 
-	return err
+	return nil
 }
 
 func IsAdminUserPath(path string) bool {
@@ -217,17 +360,37 @@ func IsAdminUserPath(path string) bool {
 }
 
 func ReverseProxy() gin.HandlerFunc {
-	target := utils.GetEnv("TARGET_HOST", "127.0.0.1")
+	target := config.GetServerConfig().RGW.Host
 
 	return func(c *gin.Context) {
+		// The keys of a quiet multi-object delete are only in its request.
+		var deleteRequest []byte
+		if isMultiObjectDelete(c.Request) {
+			bucketName, _ := getBucketName(c.Request)
+			if hasRemovalRules(bucketName) {
+				deleteRequest, _ = ioutil.ReadAll(c.Request.Body)
+				c.Request.Body = ioutil.NopCloser(bytes.NewReader(deleteRequest))
+			}
+		}
+
+		upload := newPostUpload(c.Request)
+
 		director := func(req *http.Request) {
 			req.URL.Scheme = "http"
 			req.URL.Host = target
 		}
 
-		modifyResponse := func(resp *http.Response) error {
+		modifyResponse := func(resp *http.Response) (err error) {
 			clientReq := resp.Request
 
+			// Events are a side effect, they must never break the response.
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("producing event for %s %s panicked: %v", clientReq.Method, clientReq.URL.Path, r)
+					err = nil
+				}
+			}()
+
 			switch {
 			case IsAdminUserPath(clientReq.URL.Path) && resp.StatusCode == 200:
 				b, _ := ioutil.ReadAll(resp.Body)
@@ -235,18 +398,59 @@ func ReverseProxy() gin.HandlerFunc {
 				go HandleNfsExport(clientReq, b)
 				resp.Body = ioutil.NopCloser(bytes.NewReader(b)) // put body back for client response
 				return nil
+			case isMultipartRequest(clientReq):
+				if checkResponse(resp, "POST", 200) {
+					return sendCompleteMultipartUploadEvent(resp)
+				}
+				return nil
+			case upload != nil:
+				switch resp.StatusCode {
+				case 200, 201, 204:
+					return sendPostEvent(resp, upload)
+				}
+				return nil
+			case isMultiObjectDelete(clientReq):
+				if resp.StatusCode == 200 {
+					return sendMultiObjectDeleteEvents(resp, deleteRequest)
+				}
+				return nil
+			case isObjectSubresource(clientReq, "tagging"):
+				switch {
+				case checkResponse(resp, "PUT", 200):
+					return sendSubresourceEvent(resp, event.ObjectTaggingPut)
+				case checkResponse(resp, "DELETE", 204):
+					return sendSubresourceEvent(resp, event.ObjectTaggingDelete)
+				}
+				return nil
+			case isObjectSubresource(clientReq, "acl"):
+				if checkResponse(resp, "PUT", 200) {
+					return sendSubresourceEvent(resp, event.ObjectAclPut)
+				}
+				return nil
+			case isBucketRequest(clientReq):
+				switch {
+				case checkResponse(resp, "PUT", 200):
+					return sendBucketEvent(resp, event.BucketCreated)
+				case checkResponse(resp, "DELETE", 204):
+					return sendBucketEvent(resp, event.BucketRemoved)
+				}
+				return nil
 			case len(clientReq.Header["X-Amz-Copy-Source"]) > 0:
 				return sendEvent(resp, event.ObjectCreatedCopy)
 			case len(resp.Header["Etag"]) > 0 && checkResponse(resp, "PUT", 200):
 				return sendEvent(resp, event.ObjectCreatedPut)
 			case checkResponse(resp, "DELETE", 204):
-				return sendEvent(resp, event.ObjectRemovedDelete)
+				return sendDeleteEvent(resp)
+			case isObjectRead(resp, "GET"):
+				return sendAccessEvent(resp, event.ObjectAccessedGet)
+			case isObjectRead(resp, "HEAD"):
+				return sendAccessEvent(resp, event.ObjectAccessedHead)
 			default:
 				return nil
 			}
 		}
 
 		proxy := &httputil.ReverseProxy{Director: director, ModifyResponse: modifyResponse}
-		proxy.ServeHTTP(c.Writer, c.Request)
+		proxy.ServeHTTP(c.Writer, withRequestAuth(c.Request))
 	}
 }
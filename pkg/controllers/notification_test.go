@@ -0,0 +1,604 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio/pkg/event"
+	"github.com/minio/minio/pkg/event/target"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+func TestGetObjectName(t *testing.T) {
+	os.Setenv("RGW_DNS_NAME", "cloud.example.com")
+	defer os.Unsetenv("RGW_DNS_NAME")
+	config.SetServerConfig()
+
+	Convey("Given object requests", t, func() {
+		cases := []struct {
+			url    string
+			bucket string
+			key    string
+		}{
+			{"http://cloud.example.com/photos/2018/cat.jpg", "photos", "2018/cat.jpg"},
+			{"http://cloud.example.com:8080/photos/cat.jpg", "photos", "cat.jpg"},
+			{"http://photos.cloud.example.com/2018/cat.jpg", "photos", "2018/cat.jpg"},
+			{"http://photos.cloud.example.com:8080/my%20cat+dog.jpg", "photos", "my cat+dog.jpg"},
+			{"http://10.0.0.1/photos/a%2Fb.jpg", "photos", "a/b.jpg"},
+		}
+
+		Convey("The bucket and decoded key should be resolved", func() {
+			for _, c := range cases {
+				req, _ := http.NewRequest("PUT", c.url, nil)
+				bucket, key, err := getObjectName(req)
+				So(err, ShouldBeNil)
+				So(bucket, ShouldEqual, c.bucket)
+				So(key, ShouldEqual, c.key)
+			}
+		})
+
+		Convey("Bucket requests should not be object requests", func() {
+			for _, u := range []string{"http://cloud.example.com/photos", "http://photos.cloud.example.com/"} {
+				req, _ := http.NewRequest("PUT", u, nil)
+				_, _, err := getObjectName(req)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+
+	Convey("Event keys should be encoded like S3", t, func() {
+		So(eventKey("2018/my cat+dog.jpg"), ShouldEqual, "2018/my+cat%2Bdog.jpg")
+	})
+}
+
+func TestSubresourceAndBucketEvents(t *testing.T) {
+	os.Setenv("RGW_DNS_NAME", "cloud.example.com")
+	defer os.Unsetenv("RGW_DNS_NAME")
+	config.SetServerConfig()
+
+	Convey("Given object and bucket requests", t, func() {
+		request := func(method, u string) *http.Request {
+			req, _ := http.NewRequest(method, u, nil)
+			return req
+		}
+
+		Convey("Tagging and ACL requests of objects should be detected", func() {
+			So(isObjectSubresource(request("PUT", "http://cloud.example.com/photos/cat.jpg?tagging"), "tagging"), ShouldBeTrue)
+			So(isObjectSubresource(request("PUT", "http://photos.cloud.example.com/cat.jpg?acl"), "acl"), ShouldBeTrue)
+			So(isObjectSubresource(request("PUT", "http://cloud.example.com/photos/cat.jpg"), "tagging"), ShouldBeFalse)
+			So(isObjectSubresource(request("PUT", "http://cloud.example.com/photos?tagging"), "tagging"), ShouldBeFalse)
+		})
+
+		Convey("Only requests to the bucket itself should be bucket requests", func() {
+			So(isBucketRequest(request("PUT", "http://cloud.example.com/photos")), ShouldBeTrue)
+			So(isBucketRequest(request("DELETE", "http://photos.cloud.example.com/")), ShouldBeTrue)
+			So(isBucketRequest(request("PUT", "http://cloud.example.com/photos?versioning")), ShouldBeFalse)
+			So(isBucketRequest(request("PUT", "http://cloud.example.com/photos/cat.jpg")), ShouldBeFalse)
+			So(isBucketRequest(request("GET", "http://cloud.example.com/")), ShouldBeFalse)
+		})
+	})
+
+	Convey("The new event names should be parsed", t, func() {
+		names := map[string]event.Name{
+			"s3:ObjectTagging:Put":    event.ObjectTaggingPut,
+			"s3:ObjectTagging:Delete": event.ObjectTaggingDelete,
+			"s3:ObjectAcl:Put":        event.ObjectAclPut,
+			"s3:BucketCreated:*":      event.BucketCreated,
+			"s3:BucketRemoved:*":      event.BucketRemoved,
+		}
+		for s, name := range names {
+			parsed, err := event.ParseName(s)
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, name)
+			So(parsed.String(), ShouldEqual, s)
+		}
+
+		So(event.ObjectTaggingAll.Expand(), ShouldResemble, []event.Name{event.ObjectTaggingPut, event.ObjectTaggingDelete})
+		So(event.BucketCreated.IsBucketEvent(), ShouldBeTrue)
+		So(event.ObjectAclPut.IsBucketEvent(), ShouldBeFalse)
+	})
+
+	Convey("Given the notification configurations of an account", t, func() {
+		targetList = event.NewTargetList()
+		targetList.Add(resourceTarget{id: event.TargetID{Service: "sqs", ID: "tester", Name: "kaoliang"}})
+		parse := func(name string) *event.Config {
+			nConfig, err := event.ParseConfig(strings.NewReader(`<NotificationConfiguration>
+	<QueueConfiguration>
+		<Queue>arn:aws:sqs:us-east-1:tester:kaoliang</Queue>
+		<Event>`+name+`</Event>
+	</QueueConfiguration>
+</NotificationConfiguration>`), "us-east-1", targetList)
+			So(err, ShouldBeNil)
+			return nConfig
+		}
+
+		Convey("Bucket events should be accepted", func() {
+			So(validateAccountConfig(parse("s3:BucketCreated:*")), ShouldBeNil)
+		})
+
+		Convey("Object events should be rejected", func() {
+			err := validateAccountConfig(parse("s3:ObjectCreated:Put"))
+			So(err, ShouldHaveSameTypeAs, &event.ErrInvalidEventName{})
+		})
+	})
+}
+
+func TestObjectFromHeader(t *testing.T) {
+	Convey("Given the headers of an object", t, func() {
+		header := http.Header{
+			"Etag":             {`"d41d8cd98f00b204e9800998ecf8427e"`},
+			"Content-Type":     {"image/jpeg"},
+			"Content-Length":   {"1024"},
+			"X-Amz-Version-Id": {"v1"},
+			"X-Amz-Meta-Owner": {"tester"},
+		}
+
+		Convey("The event metadata should be filled from them", func() {
+			object := objectFromHeader("2018/my cat.jpg", header)
+			So(object.Key, ShouldEqual, "2018/my+cat.jpg")
+			So(object.ETag, ShouldEqual, "d41d8cd98f00b204e9800998ecf8427e")
+			So(object.ContentType, ShouldEqual, "image/jpeg")
+			So(object.Size, ShouldEqual, 1024)
+			So(object.VersionID, ShouldEqual, "v1")
+			So(object.UserMetadata, ShouldResemble, map[string]string{"X-Amz-Meta-Owner": "tester"})
+		})
+	})
+}
+
+func TestPostUpload(t *testing.T) {
+	config.SetServerConfig()
+	targetList = event.NewTargetList()
+	targetList.Add(resourceTarget{id: event.TargetID{Service: "sqs", ID: "tester", Name: "kaoliang"}})
+	nConfig, _ := event.ParseConfig(strings.NewReader(`<NotificationConfiguration><QueueConfiguration>
+		<Queue>arn:aws:sqs:us-east-1:tester:kaoliang</Queue><Event>s3:ObjectCreated:Post</Event>
+	</QueueConfiguration></NotificationConfiguration>`), "us-east-1", targetList)
+	bucketRules.reset()
+	bucketRules.put("forms", newBucketNotification(nConfig))
+
+	Convey("Given a form upload", t, func() {
+		var form bytes.Buffer
+		w := multipart.NewWriter(&form)
+		w.WriteField("key", "uploads/${filename}")
+		w.WriteField("Content-Type", "text/plain")
+		w.WriteField("x-amz-meta-owner", "tester")
+		file, _ := w.CreateFormFile("file", "hello.txt")
+		file.Write(bytes.Repeat([]byte("hello"), 100000))
+		w.Close()
+		sent := form.Bytes()
+
+		req, _ := http.NewRequest("POST", "http://localhost/forms", bytes.NewReader(sent))
+		req.Header.Set("Content-Type", w.FormDataContentType())
+
+		Convey("The form should reach RGW unchanged and its fields should be parsed", func() {
+			upload := newPostUpload(req)
+			So(upload, ShouldNotBeNil)
+
+			received, err := ioutil.ReadAll(req.Body)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(received, sent), ShouldBeTrue)
+
+			<-upload.done
+			So(upload.err, ShouldBeNil)
+			So(upload.objectName(), ShouldEqual, "uploads/hello.txt")
+			So(upload.size, ShouldEqual, 500000)
+			So(upload.fields["content-type"], ShouldEqual, "text/plain")
+		})
+	})
+
+	Convey("Given a form upload to a bucket without Post rules", t, func() {
+		req, _ := http.NewRequest("POST", "http://localhost/other", strings.NewReader(""))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+
+		Convey("It should not be parsed", func() {
+			bucketRules.put("other", &bucketNotification{rules: event.RulesMap{}})
+			So(newPostUpload(req), ShouldBeNil)
+		})
+	})
+}
+
+func TestEventRetryBackoff(t *testing.T) {
+	Convey("Retries of an event should back off exponentially up to a limit", t, func() {
+		So(eventRetryBackoff(1), ShouldEqual, eventRetryDelay)
+		So(eventRetryBackoff(2), ShouldEqual, 2*eventRetryDelay)
+		So(eventRetryBackoff(4), ShouldEqual, 8*eventRetryDelay)
+		So(eventRetryBackoff(100), ShouldEqual, maxEventRetryDelay)
+	})
+}
+
+func TestEventLog(t *testing.T) {
+	os.Setenv("DATABASE_URL", "root:my-secret-pw@tcp(127.0.0.1:3306)/test_kaoliang?charset=utf8&parseTime=True&loc=Local")
+	config.SetServerConfig()
+	models.SetDB()
+	models.Migrate()
+
+	db := models.GetDB()
+	defer db.Exec("TRUNCATE TABLE event_logs;")
+	defer db.Exec("TRUNCATE TABLE outbox_events;")
+
+	queue := event.TargetID{Service: "sqs", ID: "tester", Name: "kaoliang"}
+	topic := event.TargetID{Service: "sns", ID: "tester", Name: "alerts"}
+	newEvent := func(name event.Name, age time.Duration) event.Event {
+		e := event.Event{EventName: name, EventTime: time.Now().UTC().Add(-age).Format(event.AMZTimeFormat)}
+		e.S3.Bucket.Name = "photos"
+		return e
+	}
+
+	Convey("Given logged events of a bucket", t, func() {
+		db.Exec("TRUNCATE TABLE event_logs;")
+		db.Exec("TRUNCATE TABLE outbox_events;")
+		So(enqueueEvent(queue, newEvent(event.ObjectCreatedPut, time.Hour)), ShouldBeNil)
+		So(enqueueEvent(topic, newEvent(event.ObjectCreatedPut, time.Hour)), ShouldBeNil)
+		So(enqueueEvent(queue, newEvent(event.ObjectRemovedDelete, time.Hour)), ShouldBeNil)
+		So(enqueueEvent(queue, newEvent(event.ObjectCreatedPut, 30*24*time.Hour)), ShouldBeNil)
+
+		Convey("Each should be logged beside its outbox event", func() {
+			count := 0
+			db.Model(&models.EventLog{}).Count(&count)
+			So(count, ShouldEqual, 4)
+			db.Model(&models.OutboxEvent{}).Count(&count)
+			So(count, ShouldEqual, 4)
+		})
+
+		Convey("Events older than the retention should be pruned", func() {
+			pruneEventLog()
+			count := 0
+			db.Model(&models.EventLog{}).Count(&count)
+			So(count, ShouldEqual, 3)
+		})
+
+		Convey("Replays should only enqueue the events asked for", func() {
+			replay := ReplayRequest{Bucket: "photos", From: time.Now().Add(-2 * time.Hour)}
+			body, err := replayEventLog(replay, []string{event.ObjectCreatedPut.String()})
+			So(err, ShouldBeNil)
+			So(body.Replayed, ShouldEqual, 2)
+
+			replay.Target = queue.ToARN("us-east-1").String()
+			body, err = replayEventLog(replay, nil)
+			So(err, ShouldBeNil)
+			So(body.Replayed, ShouldEqual, 2)
+
+			replay.After = body.LastID
+			body, err = replayEventLog(replay, nil)
+			So(err, ShouldBeNil)
+			So(body.Replayed, ShouldEqual, 0)
+
+			replayed := models.OutboxEvent{}
+			db.Last(&replayed)
+			So(replayed.Payload, ShouldContainSubstring, `"replay":true`)
+		})
+	})
+}
+
+func TestRegisteredTarget(t *testing.T) {
+	config.SetServerConfig()
+
+	Convey("Given a webhook target", t, func() {
+		var authHeader string
+		var body event.Log
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader = r.Header.Get("Authorization")
+			json.NewDecoder(r.Body).Decode(&body)
+		}))
+		defer server.Close()
+
+		webhook := models.Target{Name: "hook", Type: "webhook", Endpoint: server.URL, AuthHeader: "Bearer secret"}
+		target, err := newRegisteredTarget(webhook)
+		So(err, ShouldBeNil)
+		So(target.ID().ToARN(config.GetServerConfig().Region).String(), ShouldEqual, webhook.ARN())
+
+		Convey("Events should be posted with the auth header", func() {
+			newEvent := event.Event{EventName: event.ObjectCreatedPut}
+			newEvent.S3.Bucket.Name = "bucket"
+			newEvent.S3.Object.Key = "key"
+
+			So(target.Send(newEvent), ShouldBeNil)
+			So(authHeader, ShouldEqual, "Bearer secret")
+			So(body.Key, ShouldEqual, "bucket/key")
+			So(body.Records, ShouldHaveLength, 1)
+		})
+	})
+
+	Convey("Given target endpoints", t, func() {
+		Convey("Database endpoints should name the database and table", func() {
+			args, err := parseTargetArgs(models.Target{Type: "mysql", Endpoint: "mysql://user:secret@db:3306/events/log?format=namespace"})
+			So(err, ShouldBeNil)
+			So(args.(target.MySQLArgs).DSN, ShouldEqual, "user:secret@tcp(db:3306)/events")
+			So(args.(target.MySQLArgs).Table, ShouldEqual, "log")
+			So(args.(target.MySQLArgs).Format, ShouldEqual, event.NamespaceFormat)
+
+			args, err = parseTargetArgs(models.Target{Type: "postgresql", Endpoint: "postgres://user:secret@db:5432/events/log?sslmode=disable"})
+			So(err, ShouldBeNil)
+			So(args.(target.PostgreSQLArgs).ConnectionString, ShouldEqual, "postgres://user:secret@db:5432/events?sslmode=disable")
+			So(args.(target.PostgreSQLArgs).Format, ShouldEqual, event.AccessFormat)
+
+			_, err = parseTargetArgs(models.Target{Type: "mysql", Endpoint: "mysql://db:3306/events"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Webhook endpoints should be http or https URLs", func() {
+			_, err := parseTargetArgs(models.Target{Type: "webhook", Endpoint: "ftp://example.com"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Passwords should not be shown", func() {
+			So(redactEndpoint("mysql://user:secret@db:3306/events/log"), ShouldEqual, "mysql://user@db:3306/events/log")
+		})
+	})
+}
+
+func TestFormatEvent(t *testing.T) {
+	Convey("Given a bucket event", t, func() {
+		newEvent := event.Event{
+			EventTime:        "2018-06-01T12:00:00Z",
+			EventName:        event.ObjectRemovedDeleteMarkerCreated,
+			AwsRegion:        "us-east-1",
+			ResponseElements: map[string]string{"x-amz-request-id": "request"},
+		}
+		newEvent.S3.Bucket.Name = "bucket"
+		newEvent.S3.Bucket.ARN = "arn:aws:s3:::bucket"
+		newEvent.S3.Object.Key = "a+b"
+
+		Convey("The S3 format should wrap it in records", func() {
+			payload, err := formatEvent(s3Payload, newEvent)
+			So(err, ShouldBeNil)
+
+			records := s3Records{}
+			So(json.Unmarshal(payload.body, &records), ShouldBeNil)
+			So(records.Records, ShouldHaveLength, 1)
+		})
+
+		Convey("CloudEvents should carry it as data", func() {
+			payload, err := formatEvent(cloudEventsPayload, newEvent)
+			So(err, ShouldBeNil)
+
+			ce := cloudEvent{}
+			So(json.Unmarshal(payload.body, &ce), ShouldBeNil)
+			So(ce.SpecVersion, ShouldEqual, "1.0")
+			So(ce.Type, ShouldEqual, "com.amazonaws.s3.ObjectRemoved:DeleteMarkerCreated")
+			So(ce.Source, ShouldEqual, "arn:aws:s3:::bucket")
+			So(ce.Subject, ShouldEqual, "a b")
+			So(ce.ID, ShouldEqual, eventID(newEvent))
+
+			binary, err := formatEvent(cloudEventsBinaryPayload, newEvent)
+			So(err, ShouldBeNil)
+			So(binary.header.Get("Ce-Id"), ShouldEqual, ce.ID)
+			So(binary.header.Get("Ce-Type"), ShouldEqual, ce.Type)
+			So(binary.header.Get("Ce-Subject"), ShouldEqual, "a%20b")
+		})
+
+		Convey("Headers of binary CloudEvents should be percent-encoded", func() {
+			So(ceHeaderValue("logs/\x01é\"%.txt"), ShouldEqual, "logs/%01%C3%A9%22%25.txt")
+		})
+
+		Convey("EventBridge should describe it as a deletion", func() {
+			payload, err := formatEvent(eventBridgePayload, newEvent)
+			So(err, ShouldBeNil)
+
+			eb := eventBridgeEvent{}
+			So(json.Unmarshal(payload.body, &eb), ShouldBeNil)
+			So(eb.DetailType, ShouldEqual, "Object Deleted")
+			So(eb.Detail.DeletionType, ShouldEqual, "Delete Marker Created")
+			So(eb.Detail.Object.Key, ShouldEqual, "a b")
+			So(eb.Detail.RequestID, ShouldEqual, "request")
+		})
+	})
+
+	Convey("The binary mode of CloudEvents should only be taken over HTTP", t, func() {
+		So(validatePayloadFormat(cloudEventsBinaryPayload, true), ShouldBeNil)
+		So(validatePayloadFormat(cloudEventsBinaryPayload, false), ShouldNotBeNil)
+		So(validatePayloadFormat("xml", true), ShouldNotBeNil)
+	})
+}
+
+func TestFunctionConfiguration(t *testing.T) {
+	config.SetServerConfig()
+
+	Convey("Given a registered function", t, func() {
+		f := models.Function{AccountID: "tester", Name: "thumbnail", URL: "http://localhost/invoke", Timeout: 3, Concurrency: 1}
+		id, err := parseFunctionARN(f.ARN())
+		So(err, ShouldBeNil)
+		So(id, ShouldResemble, functionTargetID("tester", "thumbnail"))
+
+		targetList = event.NewTargetList()
+		targetList.Add(newFunctionTarget(f))
+
+		Convey("CloudFunctionConfiguration rules should invoke it", func() {
+			nConfig, err := event.ParseConfig(strings.NewReader(`<NotificationConfiguration><CloudFunctionConfiguration>
+				<Id>thumbnails</Id><CloudFunction>arn:aws:lambda:us-east-1:tester:function:thumbnail</CloudFunction>
+				<Event>s3:ObjectCreated:*</Event>
+			</CloudFunctionConfiguration></NotificationConfiguration>`), "us-east-1", targetList)
+			So(err, ShouldBeNil)
+
+			notification := newBucketNotification(nConfig)
+			So(notification.rules.Match(event.ObjectCreatedPut, "photo.jpg").ToSlice(), ShouldResemble, []event.TargetID{id})
+			So(notification.configIDs[id], ShouldEqual, "thumbnails")
+		})
+
+		Convey("Functions that are not registered should be rejected", func() {
+			_, err := event.ParseConfig(strings.NewReader(`<NotificationConfiguration><CloudFunctionConfiguration>
+				<CloudFunction>arn:aws:lambda:us-east-1:tester:function:missing</CloudFunction>
+				<Event>s3:ObjectCreated:*</Event>
+			</CloudFunctionConfiguration></NotificationConfiguration>`), "us-east-1", targetList)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestPutBucketNotification(t *testing.T) {
+	os.Setenv("RGW_DNS_NAME", "cloud.example.com")
+	defer os.Unsetenv("RGW_DNS_NAME")
+	config.SetServerConfig()
+
+	targetList = event.NewTargetList()
+	targetList.Add(resourceTarget{id: event.TargetID{Service: "sqs", ID: "tester", Name: "kaoliang"}})
+	bucketOwners.values["foreign"] = bucketValue{"other", time.Now()}
+	defer delete(bucketOwners.values, "foreign")
+
+	Convey("Given a notification configuration for a bucket of another account", t, func() {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest("PUT", "http://cloud.example.com/foreign?notification", strings.NewReader(`<NotificationConfiguration>
+	<QueueConfiguration>
+		<Queue>arn:aws:sqs:us-east-1:tester:kaoliang</Queue>
+		<Event>s3:ObjectCreated:*</Event>
+	</QueueConfiguration>
+</NotificationConfiguration>`))
+
+		Convey("Putting it should be denied", func() {
+			PutBucketNotification(c)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
+
+func TestIndexLog(t *testing.T) {
+	Convey("Given index log entries", t, func() {
+		Convey("Completed operations should report their events", func() {
+			eventType, ok := bilogEventName(bilogEntry{Op: "write", State: "complete"})
+			So(ok, ShouldBeTrue)
+			So(eventType, ShouldEqual, event.ObjectCreatedPut)
+
+			eventType, ok = bilogEventName(bilogEntry{Op: "link_olh_del", State: "complete", Versioned: true})
+			So(ok, ShouldBeTrue)
+			So(eventType, ShouldEqual, event.ObjectRemovedDeleteMarkerCreated)
+
+			_, ok = bilogEventName(bilogEntry{Op: "write", State: "pending"})
+			So(ok, ShouldBeFalse)
+			_, ok = bilogEventName(bilogEntry{Op: "write", State: "complete", Versioned: true})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Markers should keep one position per shard", func() {
+			So(advanceBilogMarker("", "00000000012.34.5"), ShouldEqual, "00000000012.34.5")
+
+			marker := advanceBilogMarker("", "0#00000000001.1.1")
+			marker = advanceBilogMarker(marker, "1#00000000002.2.2")
+			marker = advanceBilogMarker(marker, "0#00000000003.3.3")
+			So(marker, ShouldEqual, "0#00000000003.3.3,1#00000000002.2.2")
+		})
+	})
+}
+
+func TestReplication(t *testing.T) {
+	config.SetServerConfig()
+
+	Convey("Given a replicated bucket", t, func() {
+		objects := map[string]string{"docs/a.txt": "hello"}
+		source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, ok := objects[strings.TrimPrefix(r.URL.Path, "/photos/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-Amz-Meta-Owner", "tester")
+			w.Header().Set("X-Amz-Storage-Class", "STANDARD_IA")
+			w.Write([]byte(body))
+		}))
+		defer source.Close()
+		config.GetServerConfig().RGW.Host = strings.TrimPrefix(source.URL, "http://")
+
+		var requests []*http.Request
+		var bodies []string
+		destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, r)
+			bodies = append(bodies, string(body))
+			switch {
+			case r.Method == "DELETE":
+				w.WriteHeader(http.StatusNoContent)
+			case r.URL.Query().Get("partNumber") != "":
+				w.Header().Set("ETag", `"part-`+r.URL.Query().Get("partNumber")+`"`)
+			case r.Method == "POST" && r.URL.Query().Get("uploadId") == "":
+				w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`))
+			}
+		}))
+		defer destination.Close()
+
+		target, err := newReplicationTarget(models.Replication{
+			Bucket:            "photos",
+			Endpoint:          destination.URL,
+			DestinationBucket: "photos-dr",
+			Prefixes:          `["docs/"]`,
+			StorageClasses:    `{"STANDARD_IA":"COLD"}`,
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Only changes of keys under the prefixes should be replicated", func() {
+			replications.targets["photos"] = target
+			defer delete(replications.targets, "photos")
+
+			_, ok := replications.replicates("photos", "docs/a.txt", event.ObjectCreatedPut)
+			So(ok, ShouldBeTrue)
+			_, ok = replications.replicates("photos", "tmp/a.txt", event.ObjectCreatedPut)
+			So(ok, ShouldBeFalse)
+			_, ok = replications.replicates("photos", "docs/a.txt", event.ObjectAccessedGet)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Objects in the bucket should be copied with their metadata", func() {
+			operation, err := target.replicate("docs/a.txt")
+			So(err, ShouldBeNil)
+			So(operation, ShouldEqual, "copy")
+			So(requests, ShouldHaveLength, 1)
+			So(requests[0].Method, ShouldEqual, "PUT")
+			So(requests[0].URL.Path, ShouldEqual, "/photos-dr/docs/a.txt")
+			So(requests[0].Header.Get("Content-Type"), ShouldEqual, "text/plain")
+			So(requests[0].Header.Get("X-Amz-Meta-Owner"), ShouldEqual, "tester")
+			So(requests[0].Header.Get("X-Amz-Storage-Class"), ShouldEqual, "COLD")
+			So(bodies[0], ShouldEqual, "hello")
+		})
+
+		Convey("Objects larger than a single PUT should be copied in parts", func() {
+			maxSinglePutSize, replicationPartSize = 4, 2
+			defer func() { maxSinglePutSize, replicationPartSize = 5<<30, 64<<20 }()
+
+			operation, err := target.replicate("docs/a.txt")
+			So(err, ShouldBeNil)
+			So(operation, ShouldEqual, "copy")
+			So(requests, ShouldHaveLength, 5)
+			So(requests[0].Method, ShouldEqual, "POST")
+			So(requests[0].URL.RawQuery, ShouldEqual, "uploads=")
+			So(requests[0].Header.Get("X-Amz-Storage-Class"), ShouldEqual, "COLD")
+			So(bodies[1:4], ShouldResemble, []string{"he", "ll", "o"})
+			So(requests[3].URL.Query().Get("partNumber"), ShouldEqual, "3")
+			So(requests[4].URL.Query().Get("uploadId"), ShouldEqual, "upload-1")
+			So(bodies[4], ShouldContainSubstring, "<PartNumber>3</PartNumber>")
+		})
+
+		Convey("Objects gone from the bucket should be deleted", func() {
+			operation, err := target.replicate("docs/b.txt")
+			So(err, ShouldBeNil)
+			So(operation, ShouldEqual, "delete")
+			So(requests, ShouldHaveLength, 1)
+			So(requests[0].Method, ShouldEqual, "DELETE")
+			So(requests[0].URL.Path, ShouldEqual, "/photos-dr/docs/b.txt")
+		})
+	})
+}
@@ -0,0 +1,226 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/pkg/s3signer"
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+)
+
+var backendClient = &http.Client{Timeout: 10 * time.Second}
+
+// backendRequest sends a request of kaoliang's own to RGW.
+func backendRequest(method, bucket, key string, query url.Values, body io.Reader) (*http.Response, error) {
+	req, err := newBackendRequest(method, bucket, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return backendClient.Do(req)
+}
+
+// newBackendRequest prepares a signed request to RGW, for requests which
+// need a client of their own.
+func newBackendRequest(method, bucket, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	serverConfig := config.GetServerConfig()
+	u := url.URL{
+		Scheme:   "http",
+		Host:     serverConfig.RGW.Host,
+		Path:     "/" + bucket,
+		RawQuery: query.Encode(),
+	}
+	if key != "" {
+		u.Path += "/" + key
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if serverConfig.RGW.AccessKey != "" {
+		req = s3signer.SignV4(*req, serverConfig.RGW.AccessKey, serverConfig.RGW.SecretKey, "", serverConfig.Region)
+	}
+
+	return req, nil
+}
+
+// headObject reads the metadata of an object, or of one version of it, from
+// RGW.
+func headObject(bucket, key, versionID string) (*http.Response, error) {
+	query := url.Values{}
+	if versionID != "" {
+		query.Set("versionId", versionID)
+	}
+
+	resp, err := backendRequest("HEAD", bucket, key, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HEAD %s/%s responded with %s", bucket, key, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// objectFromHeader fills the event metadata of an object from the headers
+// S3 sends and receives with it.
+func objectFromHeader(objectName string, header http.Header) event.Object {
+	object := event.Object{
+		Key:         eventKey(objectName),
+		ETag:        strings.Trim(header.Get("Etag"), `"`),
+		ContentType: header.Get("Content-Type"),
+		VersionID:   header.Get("X-Amz-Version-Id"),
+	}
+
+	if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		object.Size = size
+	}
+
+	for key, values := range header {
+		if strings.HasPrefix(key, "X-Amz-Meta-") && len(values) > 0 {
+			if object.UserMetadata == nil {
+				object.UserMetadata = map[string]string{}
+			}
+			object.UserMetadata[key] = values[0]
+		}
+	}
+
+	return object
+}
+
+type bucketValue struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// bucketValueCache holds a setting of each bucket read from RGW for as long
+// as notification rules are cached.
+type bucketValueCache struct {
+	sync.Mutex
+	values map[string]bucketValue
+	fetch  func(bucket string) (string, error)
+}
+
+func newBucketValueCache(fetch func(bucket string) (string, error)) *bucketValueCache {
+	return &bucketValueCache{values: map[string]bucketValue{}, fetch: fetch}
+}
+
+func (c *bucketValueCache) get(bucket string) (string, error) {
+	c.Lock()
+	v, ok := c.values[bucket]
+	c.Unlock()
+	if ok && time.Since(v.fetchedAt) < rulesCacheTTL {
+		return v.value, nil
+	}
+
+	value, err := c.fetch(bucket)
+	if err != nil {
+		return "", err
+	}
+
+	c.Lock()
+	c.values[bucket] = bucketValue{value, time.Now()}
+	c.Unlock()
+
+	return value, nil
+}
+
+var (
+	bucketOwners     = newBucketValueCache(fetchBucketOwner)
+	bucketVersioning = newBucketValueCache(fetchBucketVersioning)
+)
+
+// getBucketSubresource reads a subresource document of bucket into v.
+func getBucketSubresource(bucket, subresource string, v interface{}) error {
+	resp, err := backendRequest("GET", bucket, "", url.Values{subresource: {""}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s?%s responded with %s", bucket, subresource, resp.Status)
+	}
+
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+func fetchBucketOwner(bucket string) (string, error) {
+	policy := AccessControlPolicy{}
+	if err := getBucketSubresource(bucket, "acl", &policy); err != nil {
+		return "", err
+	}
+
+	return policy.Owner.ID, nil
+}
+
+func fetchBucketVersioning(bucket string) (string, error) {
+	versioning := VersioningConfiguration{}
+	if err := getBucketSubresource(bucket, "versioning", &versioning); err != nil {
+		return "", err
+	}
+
+	return versioning.Status, nil
+}
+
+// listAccountBuckets returns the names of the buckets accountID owns, from
+// the admin API of RGW.
+var listAccountBuckets = func(accountID string) ([]string, error) {
+	resp, err := backendRequest("GET", "admin", "bucket", url.Values{"uid": {accountID}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing buckets of %s responded with %s", accountID, resp.Status)
+	}
+
+	buckets := []string{}
+	if err := json.NewDecoder(resp.Body).Decode(&buckets); err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// getBucketOwner returns the id of the owner of bucket from its ACL.
+func getBucketOwner(bucket string) (string, error) {
+	return bucketOwners.get(bucket)
+}
+
+// isBucketVersioned reports whether deleting from bucket leaves delete
+// markers, which is the case once versioning was ever enabled.
+func isBucketVersioned(bucket string) (bool, error) {
+	status, err := bucketVersioning.get(bucket)
+	return status != "", err
+}
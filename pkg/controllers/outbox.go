@@ -0,0 +1,563 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+const (
+	maxEventAttempts   = 8
+	eventRetryDelay    = time.Second
+	maxEventRetryDelay = 5 * time.Minute
+	dispatchInterval   = time.Second
+	dispatchBatchSize  = 100
+	// eventLease is how long a dispatcher owns an event it is delivering
+	// before other dispatchers may take it over. Deliveries on workers
+	// renew it while they run.
+	eventLease = time.Minute
+
+	eventLogPruneInterval = time.Hour
+	replayBatchSize       = 500
+)
+
+var dispatchWakeup = make(chan struct{}, 1)
+
+// Events are delivered on workers beside the dispatcher, bounded for each
+// service, so slow targets hold up no other service. Functions and
+// replications may take long and have pools of their own size.
+const (
+	serviceWorkers = 16
+	// maxTargetDeliveries bounds the deliveries to a single target, so a
+	// hung one can't take up all workers of its service.
+	maxTargetDeliveries = 4
+)
+
+var workerPoolSizes = map[string]int{
+	functionService:    functionWorkers,
+	replicationService: replicationWorkers,
+}
+
+// deliveryWorkers are the worker slots of each service with events. They
+// are only added to by the dispatcher.
+var deliveryWorkers = map[string]chan struct{}{}
+
+func serviceSlots(service string) chan struct{} {
+	slots, ok := deliveryWorkers[service]
+	if !ok {
+		size, ok := workerPoolSizes[service]
+		if !ok {
+			size = serviceWorkers
+		}
+		slots = make(chan struct{}, size)
+		deliveryWorkers[service] = slots
+	}
+
+	return slots
+}
+
+// busyServices are the services whose workers are all delivering.
+func busyServices() []string {
+	busy := []string{}
+	for service, slots := range deliveryWorkers {
+		if len(slots) == cap(slots) {
+			busy = append(busy, service)
+		}
+	}
+
+	return busy
+}
+
+// targetDeliveries counts the deliveries in progress to each target.
+type targetDeliveries struct {
+	sync.Mutex
+	counts map[event.TargetID]int
+}
+
+var inFlight = &targetDeliveries{counts: map[event.TargetID]int{}}
+
+func (d *targetDeliveries) acquire(targetID event.TargetID) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.counts[targetID] >= maxTargetDeliveries {
+		return false
+	}
+	d.counts[targetID]++
+
+	return true
+}
+
+// busy returns the targets which take no more deliveries.
+func (d *targetDeliveries) busy() []event.TargetID {
+	d.Lock()
+	defer d.Unlock()
+
+	busy := []event.TargetID{}
+	for targetID, count := range d.counts {
+		if count >= maxTargetDeliveries {
+			busy = append(busy, targetID)
+		}
+	}
+
+	return busy
+}
+
+func (d *targetDeliveries) release(targetID event.TargetID) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.counts[targetID]--; d.counts[targetID] <= 0 {
+		delete(d.counts, targetID)
+	}
+}
+
+func outboxTargetID(row models.OutboxEvent) event.TargetID {
+	return event.TargetID{Service: row.TargetService, ID: row.TargetAccount, Name: row.TargetName}
+}
+
+// enqueueEvent stores newEvent in the outbox, from where the dispatcher
+// delivers it to the target, and in the event log for replays.
+func enqueueEvent(targetID event.TargetID, newEvent event.Event) error {
+	payload, err := json.Marshal(newEvent)
+	if err != nil {
+		return err
+	}
+
+	tx := models.GetDB().Begin()
+	if config.GetServerConfig().EventRetention > 0 {
+		eventTime, _ := time.Parse(event.AMZTimeFormat, newEvent.EventTime)
+		entry := models.EventLog{
+			Bucket:        newEvent.S3.Bucket.Name,
+			EventTime:     eventTime,
+			EventName:     newEvent.EventName.String(),
+			TargetService: targetID.Service,
+			TargetAccount: targetID.ID,
+			TargetName:    targetID.Name,
+			Payload:       string(payload),
+		}
+		if err := tx.Create(&entry).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := createOutboxEvent(tx, targetID, string(payload)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	wakeDispatcher()
+	return nil
+}
+
+func createOutboxEvent(db *gorm.DB, targetID event.TargetID, payload string) error {
+	row := models.OutboxEvent{
+		TargetService: targetID.Service,
+		TargetAccount: targetID.ID,
+		TargetName:    targetID.Name,
+		Payload:       payload,
+		Status:        models.EventPending,
+		NextAttemptAt: time.Now(),
+	}
+
+	return db.Create(&row).Error
+}
+
+func wakeDispatcher() {
+	select {
+	case dispatchWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// StartDispatcher delivers the events in the outbox. Several processes may
+// dispatch from the same outbox, each event is claimed by one of them.
+func StartDispatcher() {
+	go func() {
+		ticker := time.NewTicker(dispatchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-dispatchWakeup:
+			}
+
+			dispatchEvents()
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(eventLogPruneInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			pruneEventLog()
+		}
+	}()
+}
+
+// pruneEventLog drops the logged events older than the retention period.
+func pruneEventLog() {
+	retention := config.GetServerConfig().EventRetention
+	if retention <= 0 {
+		return
+	}
+
+	db := models.GetDB()
+	expiry := time.Now().UTC().Add(-retention)
+	err := db.Where("event_time < ?", expiry).Delete(models.EventLog{}).Error
+	if err != nil {
+		log.Printf("pruning event log failed: %v", err)
+	}
+
+	err = db.Where("created_at < ?", expiry).Delete(models.FunctionInvocation{}).Error
+	if err != nil {
+		log.Printf("pruning function invocations failed: %v", err)
+	}
+}
+
+func dispatchEvents() {
+	db := models.GetDB()
+	for {
+		now := time.Now()
+		rows := []models.OutboxEvent{}
+		query := db.Where("status = ? AND next_attempt_at <= ?", models.EventPending, now)
+		if busy := busyServices(); len(busy) > 0 {
+			query = query.Where("target_service NOT IN (?)", busy)
+		}
+		for _, targetID := range inFlight.busy() {
+			query = query.Not("target_service = ? AND target_account = ? AND target_name = ?", targetID.Service, targetID.ID, targetID.Name)
+		}
+		err := query.Order("id").Limit(dispatchBatchSize).Find(&rows).Error
+		if err != nil {
+			log.Printf("reading event outbox failed: %v", err)
+			return
+		}
+
+		for _, row := range rows {
+			targetID := outboxTargetID(row)
+			slots := serviceSlots(row.TargetService)
+			select {
+			case slots <- struct{}{}:
+			default:
+				continue
+			}
+			if !inFlight.acquire(targetID) {
+				<-slots
+				continue
+			}
+
+			claim := db.Model(&models.OutboxEvent{}).
+				Where("id = ? AND status = ? AND next_attempt_at <= ?", row.ID, models.EventPending, now).
+				Update("next_attempt_at", now.Add(eventLease))
+			if claim.Error != nil || claim.RowsAffected != 1 {
+				inFlight.release(targetID)
+				<-slots
+				continue
+			}
+
+			go func(row models.OutboxEvent) {
+				defer func() { <-slots }()
+				defer inFlight.release(targetID)
+				deliverLeasedEvent(row)
+			}(row)
+		}
+
+		if len(rows) < dispatchBatchSize {
+			return
+		}
+	}
+}
+
+func eventRetryBackoff(attempts int) time.Duration {
+	delay := eventRetryDelay
+	for i := 1; i < attempts && delay < maxEventRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxEventRetryDelay {
+		delay = maxEventRetryDelay
+	}
+
+	return delay
+}
+
+// deliverLeasedEvent sends an outbox event to its target however long it
+// takes, renewing its lease meanwhile so no other dispatcher delivers it
+// again. Failed deliveries are retried with exponential backoff, and once
+// out of attempts the event is kept as failed.
+func deliverLeasedEvent(row models.OutboxEvent) {
+	done := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+
+		ticker := time.NewTicker(eventLease / 3)
+		defer ticker.Stop()
+
+		db := models.GetDB()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				db.Model(&models.OutboxEvent{}).
+					Where("id = ? AND status = ?", row.ID, models.EventPending).
+					Update("next_attempt_at", time.Now().Add(eventLease))
+			}
+		}
+	}()
+
+	err := sendOutboxEvent(&row)
+	close(done)
+	<-renewed
+	finishDelivery(row, err)
+}
+
+// sendOutboxEvent sends an outbox event to its target. Events of targets
+// which do not exist are not retried.
+func sendOutboxEvent(row *models.OutboxEvent) error {
+	targetID := outboxTargetID(*row)
+
+	newEvent := event.Event{}
+	if err := json.Unmarshal([]byte(row.Payload), &newEvent); err != nil {
+		return err
+	}
+
+	if !targetList.Exists(targetID) {
+		row.Attempts = maxEventAttempts - 1
+		return errors.New("target does not exist")
+	}
+
+	var err error
+	for result := range targetList.Send(newEvent, targetID) {
+		err = result.Err
+	}
+
+	return err
+}
+
+// finishDelivery drops a delivered event from the outbox, or schedules its
+// next attempt.
+func finishDelivery(row models.OutboxEvent, err error) {
+	db := models.GetDB()
+	targetID := outboxTargetID(row)
+
+	if err == nil {
+		db.Unscoped().Delete(&row)
+		return
+	}
+
+	attempts := row.Attempts + 1
+	updates := map[string]interface{}{
+		"attempts":        attempts,
+		"last_error":      err.Error(),
+		"next_attempt_at": time.Now().Add(eventRetryBackoff(attempts)),
+	}
+	if attempts >= maxEventAttempts {
+		updates["status"] = models.EventFailed
+		log.Printf("delivering event %d to %s failed for good: %v", row.ID, targetID, err)
+	}
+
+	db.Model(&row).Updates(updates)
+}
+
+// ListFailedEvents lists the events which could not be delivered to the
+// queues and topics of the caller.
+func ListFailedEvents(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	db := models.GetDB()
+	rows := []models.OutboxEvent{}
+	db.Where("status = ? AND target_account = ?", models.EventFailed, accountID).Order("id").Find(&rows)
+
+	serverConfig := config.GetServerConfig()
+	body := FailedEventsResponse{FailedEvents: []FailedEvent{}}
+	for _, row := range rows {
+		body.FailedEvents = append(body.FailedEvents, FailedEvent{
+			ID:        row.ID,
+			Target:    outboxTargetID(row).ToARN(serverConfig.Region).String(),
+			Attempts:  row.Attempts,
+			LastError: row.LastError,
+			FailedAt:  row.UpdatedAt.UTC().Format(event.AMZTimeFormat),
+			Event:     json.RawMessage(row.Payload),
+		})
+	}
+
+	c.JSON(http.StatusOK, body)
+}
+
+// RetryFailedEvent puts a failed event back into the outbox.
+func RetryFailedEvent(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	db := models.GetDB()
+	row := models.OutboxEvent{}
+	if db.Where("id = ? AND status = ? AND target_account = ?", id, models.EventFailed, accountID).First(&row).RecordNotFound() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	db.Model(&row).Updates(map[string]interface{}{
+		"status":          models.EventPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	wakeDispatcher()
+
+	c.Status(http.StatusNoContent)
+}
+
+// ReplayEvents delivers the logged events of a bucket again, optionally only
+// those of some event names or to one target. Replayed events keep their
+// sequencer and are marked as replays. The events are enqueued in batches;
+// when one fails, the response tells how far the replay got, and the
+// request can be repeated after that point.
+func ReplayEvents(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	replay := ReplayRequest{}
+	if err := json.NewDecoder(c.Request.Body).Decode(&replay); err != nil || replay.Bucket == "" {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	owner, err := getBucketOwner(replay.Bucket)
+	if err != nil || owner != accountID {
+		writeErrorResponse(c, cmd.ErrAccessDenied)
+		return
+	}
+
+	names := []string{}
+	for _, s := range replay.Events {
+		name, err := event.ParseName(s)
+		if err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		for _, n := range name.Expand() {
+			names = append(names, n.String())
+		}
+	}
+
+	body, err := replayEventLog(replay, names)
+	if body.Replayed > 0 {
+		wakeDispatcher()
+	}
+	if err != nil {
+		log.Printf("replaying events of %s failed: %v", replay.Bucket, err)
+		c.JSON(http.StatusInternalServerError, body)
+		return
+	}
+
+	c.JSON(http.StatusOK, body)
+}
+
+// replayEventLog enqueues the logged events a replay asks for, each batch
+// in a transaction of its own.
+func replayEventLog(replay ReplayRequest, names []string) (ReplayResponse, error) {
+	to := replay.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	db := models.GetDB()
+	query := db.Where("bucket = ? AND event_time >= ? AND event_time <= ?", replay.Bucket, replay.From.UTC(), to.UTC())
+	if len(names) > 0 {
+		query = query.Where("event_name IN (?)", names)
+	}
+
+	region := config.GetServerConfig().Region
+	body := ReplayResponse{LastID: replay.After}
+	for {
+		rows := []models.EventLog{}
+		if err := query.Where("id > ?", body.LastID).Order("id").Limit(replayBatchSize).Find(&rows).Error; err != nil {
+			return body, err
+		}
+		if len(rows) == 0 {
+			return body, nil
+		}
+
+		tx := db.Begin()
+		replayed := 0
+		for _, row := range rows {
+			targetID := event.TargetID{Service: row.TargetService, ID: row.TargetAccount, Name: row.TargetName}
+			if replay.Target != "" && targetID.ToARN(region).String() != replay.Target {
+				continue
+			}
+
+			newEvent := event.Event{}
+			if err := json.Unmarshal([]byte(row.Payload), &newEvent); err != nil {
+				continue
+			}
+			newEvent.Replay = true
+
+			payload, err := json.Marshal(newEvent)
+			if err != nil {
+				continue
+			}
+			if err := createOutboxEvent(tx, targetID, string(payload)); err != nil {
+				tx.Rollback()
+				return body, err
+			}
+			replayed++
+		}
+		if err := tx.Commit().Error; err != nil {
+			return body, err
+		}
+
+		body.Replayed += replayed
+		body.LastID = rows[len(rows)-1].ID
+		if len(rows) < replayBatchSize {
+			return body, nil
+		}
+	}
+}
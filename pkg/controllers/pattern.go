@@ -0,0 +1,274 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// eventPattern is an EventBridge style pattern compiled from JSON. Its
+// fields name fields of the event, and lead either to more fields or to a
+// list of values and operators of which the field has to match one:
+//
+//	{"s3": {"object": {"size": [{"numeric": [">", 1048576]}]}},
+//	 "requestParameters": {"sourceIPAddress": [{"cidr": "10.0.0.0/8"}]}}
+type eventPattern struct {
+	fields   map[string]*eventPattern
+	matchers []valueMatcher
+}
+
+// valueMatcher matches the value of an event field, which is nil when the
+// event does not have the field.
+type valueMatcher func(v interface{}, exists bool) bool
+
+func compileEventPattern(data []byte) (*eventPattern, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	fields, ok := v.(map[string]interface{})
+	if !ok || len(fields) == 0 {
+		return nil, errors.New("pattern must be a non-empty object")
+	}
+
+	return compileFields(fields)
+}
+
+func compileFields(fields map[string]interface{}) (*eventPattern, error) {
+	p := &eventPattern{fields: map[string]*eventPattern{}}
+	for name, v := range fields {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			child, err := compileFields(v)
+			if err != nil {
+				return nil, err
+			}
+			p.fields[name] = child
+		case []interface{}:
+			if len(v) == 0 {
+				return nil, fmt.Errorf("%s: values must not be empty", name)
+			}
+
+			child := &eventPattern{}
+			for _, value := range v {
+				matcher, err := compileMatcher(value)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", name, err)
+				}
+				child.matchers = append(child.matchers, matcher)
+			}
+			p.fields[name] = child
+		default:
+			return nil, fmt.Errorf("%s: values must be in a list", name)
+		}
+	}
+
+	return p, nil
+}
+
+func compileMatcher(value interface{}) (valueMatcher, error) {
+	op, ok := value.(map[string]interface{})
+	if !ok {
+		if _, ok := value.([]interface{}); ok {
+			return nil, errors.New("values must not be lists")
+		}
+
+		return func(v interface{}, exists bool) bool {
+			return exists && v == value
+		}, nil
+	}
+
+	if len(op) != 1 {
+		return nil, errors.New("operators must be objects with a single key")
+	}
+
+	for name, arg := range op {
+		switch name {
+		case "prefix", "suffix", "equals-ignore-case":
+			s, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s takes a string", name)
+			}
+
+			match := map[string]func(string) bool{
+				"prefix":             func(v string) bool { return strings.HasPrefix(v, s) },
+				"suffix":             func(v string) bool { return strings.HasSuffix(v, s) },
+				"equals-ignore-case": func(v string) bool { return strings.EqualFold(v, s) },
+			}[name]
+
+			return func(v interface{}, exists bool) bool {
+				str, ok := v.(string)
+				return exists && ok && match(str)
+			}, nil
+		case "anything-but":
+			var inner []valueMatcher
+			switch arg := arg.(type) {
+			case []interface{}:
+				for _, value := range arg {
+					matcher, err := compileMatcher(value)
+					if err != nil {
+						return nil, err
+					}
+					inner = append(inner, matcher)
+				}
+			default:
+				matcher, err := compileMatcher(arg)
+				if err != nil {
+					return nil, err
+				}
+				inner = append(inner, matcher)
+			}
+
+			return func(v interface{}, exists bool) bool {
+				if !exists {
+					return false
+				}
+				for _, matcher := range inner {
+					if matcher(v, exists) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		case "numeric":
+			return compileNumeric(arg)
+		case "exists":
+			want, ok := arg.(bool)
+			if !ok {
+				return nil, errors.New("exists takes true or false")
+			}
+
+			return func(v interface{}, exists bool) bool {
+				return exists == want
+			}, nil
+		case "cidr":
+			s, ok := arg.(string)
+			if !ok {
+				return nil, errors.New("cidr takes a string")
+			}
+
+			_, network, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+
+			return func(v interface{}, exists bool) bool {
+				str, ok := v.(string)
+				if !exists || !ok {
+					return false
+				}
+				ip := net.ParseIP(str)
+				return ip != nil && network.Contains(ip)
+			}, nil
+		}
+
+		return nil, fmt.Errorf("unknown operator %s", name)
+	}
+
+	return nil, nil
+}
+
+// compileNumeric compiles comparisons like [">", 0, "<=", 5].
+func compileNumeric(arg interface{}) (valueMatcher, error) {
+	args, ok := arg.([]interface{})
+	if !ok || len(args) == 0 || len(args)%2 != 0 {
+		return nil, errors.New("numeric takes pairs of an operator and a number")
+	}
+
+	var comparisons []func(float64) bool
+	for i := 0; i < len(args); i += 2 {
+		op, _ := args[i].(string)
+		n, ok := args[i+1].(float64)
+		if !ok {
+			return nil, errors.New("numeric compares with numbers")
+		}
+
+		var compare func(float64) bool
+		switch op {
+		case "<":
+			compare = func(v float64) bool { return v < n }
+		case "<=":
+			compare = func(v float64) bool { return v <= n }
+		case "=":
+			compare = func(v float64) bool { return v == n }
+		case ">=":
+			compare = func(v float64) bool { return v >= n }
+		case ">":
+			compare = func(v float64) bool { return v > n }
+		default:
+			return nil, fmt.Errorf("unknown numeric operator %q", op)
+		}
+		comparisons = append(comparisons, compare)
+	}
+
+	return func(v interface{}, exists bool) bool {
+		n, ok := v.(float64)
+		if !exists || !ok {
+			return false
+		}
+		for _, compare := range comparisons {
+			if !compare(n) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// match reports whether the event, decoded from its JSON into generic
+// values, matches the pattern.
+func (p *eventPattern) match(v interface{}, exists bool) bool {
+	if p.fields == nil {
+		values, ok := v.([]interface{})
+		if !ok {
+			values = []interface{}{v}
+		}
+
+		for _, matcher := range p.matchers {
+			for _, value := range values {
+				if matcher(value, exists) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	fields, _ := v.(map[string]interface{})
+	for name, child := range p.fields {
+		value, ok := fields[name]
+		if !child.match(value, ok) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesEventName reports whether events named name can match the
+// pattern, which they always can when it leaves the name open.
+func (p *eventPattern) matchesEventName(name string) bool {
+	child, ok := p.fields["eventName"]
+	if !ok {
+		return true
+	}
+
+	return child.match(name, true)
+}
@@ -0,0 +1,179 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minio/minio/pkg/event"
+)
+
+const (
+	maxFormFieldSize = 64 * 1024
+	formParseTimeout = 5 * time.Second
+)
+
+// postUpload collects the fields of a browser form upload while the form
+// is streamed to RGW, so the file is never held in memory.
+type postUpload struct {
+	bucketName string
+	fields     map[string]string
+	filename   string
+	size       int64
+	err        error
+	done       chan struct{}
+}
+
+// formBody passes the request body on to RGW and copies it to the form
+// parser.
+type formBody struct {
+	body io.ReadCloser
+	tee  io.Reader
+	pw   *io.PipeWriter
+}
+
+func (b *formBody) Read(p []byte) (int, error) {
+	n, err := b.tee.Read(p)
+	if err == io.EOF {
+		b.pw.Close()
+	} else if err != nil {
+		b.pw.CloseWithError(err)
+	}
+
+	return n, err
+}
+
+func (b *formBody) Close() error {
+	b.pw.Close()
+	return b.body.Close()
+}
+
+func isFormUpload(req *http.Request) (string, bool) {
+	if req.Method != "POST" || req.URL.RawQuery != "" {
+		return "", false
+	}
+
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return "", false
+	}
+
+	return params["boundary"], true
+}
+
+// newPostUpload starts parsing req when it is a form upload to a bucket
+// with ObjectCreated:Post rules, and returns nil otherwise.
+func newPostUpload(req *http.Request) *postUpload {
+	boundary, ok := isFormUpload(req)
+	if !ok {
+		return nil
+	}
+
+	bucketName, objectName := getBucketName(req)
+	if bucketName == "" || objectName != "" || !hasRules(bucketName, event.ObjectCreatedPost) {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	req.Body = &formBody{body: req.Body, tee: io.TeeReader(req.Body, pw), pw: pw}
+
+	u := &postUpload{
+		bucketName: bucketName,
+		fields:     map[string]string{},
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		// Keep reading until the body ends so the upload is never blocked.
+		defer io.Copy(ioutil.Discard, pr)
+		defer close(u.done)
+
+		mr := multipart.NewReader(pr, boundary)
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				if err != io.EOF {
+					u.err = err
+				}
+				return
+			}
+
+			name := strings.ToLower(part.FormName())
+			if name == "file" {
+				// Fields after the file are ignored, like S3 does.
+				u.filename = part.FileName()
+				u.size, u.err = io.Copy(ioutil.Discard, part)
+				return
+			}
+
+			value, _ := ioutil.ReadAll(io.LimitReader(part, maxFormFieldSize))
+			u.fields[name] = string(value)
+		}
+	}()
+
+	return u
+}
+
+func (u *postUpload) objectName() string {
+	return strings.Replace(u.fields["key"], "${filename}", u.filename, -1)
+}
+
+// sendPostEvent reports an object uploaded with a browser form.
+func sendPostEvent(resp *http.Response, u *postUpload) error {
+	select {
+	case <-u.done:
+	case <-time.After(formParseTimeout):
+		log.Printf("parsing form upload to %s timed out", u.bucketName)
+		return nil
+	}
+
+	if u.err != nil {
+		log.Printf("parsing form upload to %s failed: %v", u.bucketName, u.err)
+		return nil
+	}
+
+	objectName := u.objectName()
+	match := matchObject(u.bucketName, objectName, event.ObjectCreatedPost)
+	if match == nil {
+		return nil
+	}
+
+	object := event.Object{
+		Key:         eventKey(objectName),
+		Size:        u.size,
+		ETag:        strings.Trim(resp.Header.Get("Etag"), `"`),
+		ContentType: u.fields["content-type"],
+		VersionID:   resp.Header.Get("X-Amz-Version-Id"),
+	}
+
+	for name, value := range u.fields {
+		if strings.HasPrefix(name, "x-amz-meta-") {
+			if object.UserMetadata == nil {
+				object.UserMetadata = map[string]string{}
+			}
+			object.UserMetadata[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+
+	dispatchEvent(resp, event.ObjectCreatedPost, match, object)
+	return nil
+}
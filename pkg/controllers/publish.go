@@ -0,0 +1,190 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	"github.com/satori/go.uuid"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+const (
+	maxBatchEntries     = 10
+	deduplicationWindow = 5 * time.Minute
+	messageGroupLockTTL = 5 * time.Minute
+)
+
+type publishInput struct {
+	Subject                string
+	Message                string
+	MessageGroupID         string
+	MessageDeduplicationID string
+}
+
+type senderError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func invalidParameter(message string) *senderError {
+	return &senderError{http.StatusBadRequest, "InvalidParameter", message}
+}
+
+func parseAttributes(c *gin.Context) map[string]string {
+	attributes := map[string]string{}
+	for i := 1; ; i++ {
+		key := c.PostForm(fmt.Sprintf("Attributes.entry.%d.key", i))
+		if key == "" {
+			break
+		}
+		attributes[key] = c.PostForm(fmt.Sprintf("Attributes.entry.%d.value", i))
+	}
+
+	return attributes
+}
+
+func deduplicationID(topic models.Resource, input publishInput) string {
+	if input.MessageDeduplicationID != "" {
+		return input.MessageDeduplicationID
+	}
+
+	if topic.ContentBasedDeduplication {
+		sum := sha256.Sum256([]byte(input.Message))
+		return hex.EncodeToString(sum[:])
+	}
+
+	return ""
+}
+
+// publishMessage validates a single message and fans it out to the
+// subscriptions of topic. Messages to FIFO topics are deduplicated within
+// a five minute window and delivered one at a time per message group, in
+// the order of their sequence numbers; a duplicate returns the id of the
+// message it duplicates without being delivered again.
+func publishMessage(topic models.Resource, input publishInput) (string, string, *senderError) {
+	if input.Message == "" {
+		return "", "", invalidParameter("Invalid parameter: Empty message")
+	}
+
+	if !topic.IsFIFO() {
+		if input.MessageGroupID != "" || input.MessageDeduplicationID != "" {
+			return "", "", invalidParameter("Invalid parameter: MessageGroupId and MessageDeduplicationId are only valid for FIFO topics")
+		}
+
+		messageID, _ := uuid.NewV4()
+		publish(topic, Notification{
+			Type:      "Notification",
+			MessageID: messageID.String(),
+			TopicARN:  topic.ARN(),
+			Subject:   input.Subject,
+			Message:   input.Message,
+			Timestamp: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		})
+
+		return messageID.String(), "", nil
+	}
+
+	if input.MessageGroupID == "" {
+		return "", "", invalidParameter("Invalid parameter: The MessageGroupId parameter is required for FIFO topics")
+	}
+
+	dedupID := deduplicationID(topic, input)
+	if dedupID == "" {
+		return "", "", invalidParameter("Invalid parameter: The topic should either have ContentBasedDeduplication enabled or MessageDeduplicationId provided explicitly")
+	}
+
+	client := models.GetCache()
+	messageID, _ := uuid.NewV4()
+	release, err := lockMessageGroup(topic, input.MessageGroupID, messageID.String())
+	if err != nil {
+		return "", "", &senderError{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+	defer release()
+
+	dedupKey := fmt.Sprintf("sns:dedup:%s:%s", topic.ARN(), dedupID)
+	duplicateID, err := client.Get(dedupKey).Result()
+	if err == nil {
+		return duplicateID, "", nil
+	}
+	if err != redis.Nil {
+		return "", "", &senderError{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+
+	sequence, err := client.Incr(fmt.Sprintf("sns:sequence:%s", topic.ARN())).Result()
+	if err != nil {
+		return "", "", &senderError{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+	sequenceNumber := fmt.Sprintf("%020d", sequence)
+
+	publish(topic, Notification{
+		Type:           "Notification",
+		MessageID:      messageID.String(),
+		TopicARN:       topic.ARN(),
+		Subject:        input.Subject,
+		Message:        input.Message,
+		Timestamp:      time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		SequenceNumber: sequenceNumber,
+	})
+
+	// The message only counts as published once it was handed to every
+	// subscription, so a publish that did not get this far can be retried.
+	if err := client.Set(dedupKey, messageID.String(), deduplicationWindow).Err(); err != nil {
+		log.Printf("recording deduplication id of message %s failed: %v", messageID, err)
+	}
+
+	return messageID.String(), sequenceNumber, nil
+}
+
+// lockMessageGroup waits until no other publish to the same message group
+// of topic is in progress, on this or any other process, and returns the
+// function that lets the next one go.
+func lockMessageGroup(topic models.Resource, groupID, owner string) (func(), error) {
+	lock := &redisLock{
+		key:   fmt.Sprintf("sns:group:%s:%s", topic.ARN(), groupID),
+		owner: owner,
+		ttl:   messageGroupLockTTL,
+	}
+	deadline := time.Now().Add(messageGroupLockTTL)
+
+	for {
+		ok, err := lock.acquire()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("message group %s is busy", groupID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return func() {
+		if err := lock.release(); err != nil {
+			log.Printf("releasing message group %s failed: %v", groupID, err)
+		}
+	}, nil
+}
@@ -61,13 +61,13 @@ func CreateQueue(c *gin.Context) {
 		return
 	}
 
-	var queueName string
-	switch c.Request.Method {
-	case "GET":
-		queueName = c.Query("QueueName")
-	case "POST":
-		queueName = c.PostForm("QueueName")
+	param := c.PostForm
+	if c.Request.Method == "GET" {
+		param = c.Query
 	}
+
+	queueName := param("QueueName")
+	attributes := parseQueueAttributes(param)
 	db := models.GetDB()
 
 	queue := models.Resource{
@@ -78,6 +78,18 @@ func CreateQueue(c *gin.Context) {
 
 	requestID, _ := uuid.NewV4()
 
+	payloadFormat := attributes["PayloadFormat"]
+	if err := validatePayloadFormat(payloadFormat, false); err != nil {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "InvalidAttributeValue",
+			Message:   err.Error(),
+			RequestID: requestID.String(),
+		}
+		c.XML(http.StatusBadRequest, body)
+		return
+	}
+
 	// Response Error when queue is exists
 	if !db.Where(&queue).First(&models.Resource{}).RecordNotFound() {
 		body := ErrorResponse{
@@ -90,6 +102,21 @@ func CreateQueue(c *gin.Context) {
 		return
 	}
 
+	// Registered targets are named like queues of an account named after
+	// them, so a queue may not take the name of one.
+	if isRegisteredTargetType(queueName) &&
+		!db.Where("name = ? AND type = ?", accountID, queueName).First(&models.Target{}).RecordNotFound() {
+		body := ErrorResponse{
+			Type:      "Sender",
+			Code:      "InvalidParameterValue",
+			Message:   "The queue name is taken by a registered target.",
+			RequestID: requestID.String(),
+		}
+		c.XML(http.StatusBadRequest, body)
+		return
+	}
+
+	queue.PayloadFormat = payloadFormat
 	db.Create(&queue)
 	body := CreateQueueResponse{
 		QueueURL:  queue.URL(),
@@ -99,6 +126,19 @@ func CreateQueue(c *gin.Context) {
 	c.XML(http.StatusOK, body)
 }
 
+func parseQueueAttributes(param func(string) string) map[string]string {
+	attributes := map[string]string{}
+	for i := 1; ; i++ {
+		name := param(fmt.Sprintf("Attribute.%d.Name", i))
+		if name == "" {
+			break
+		}
+		attributes[name] = param(fmt.Sprintf("Attribute.%d.Value", i))
+	}
+
+	return attributes
+}
+
 func DeleteQueue(c *gin.Context) {
 	userID, errCode := authenticate(c.Request)
 	if errCode != cmd.ErrNone {
@@ -127,7 +167,10 @@ func DeleteQueue(c *gin.Context) {
 	db := models.GetDB()
 	queue := models.Resource{}
 
-	db.Where(models.Resource{Service: models.SQS, AccountID: accountID, Name: queueName}).First(&queue)
+	if db.Where(models.Resource{Service: models.SQS, AccountID: accountID, Name: queueName}).First(&queue).RecordNotFound() {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "AWS.SimpleQueueService.NonExistentQueue", "The specified queue does not exist.")
+		return
+	}
 
 	db.Delete(&queue)
 
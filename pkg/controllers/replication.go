@@ -0,0 +1,606 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio-go/pkg/s3signer"
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+const (
+	replicationService  = "replication"
+	replicationConfigID = "replication"
+	replicationWorkers  = 4
+	maxStatusesListed   = 1000
+	maxUploadParts      = 10000
+)
+
+var (
+	// Objects larger than a single PUT may upload are copied in parts.
+	maxSinglePutSize      int64 = 5 << 30
+	replicationPartSize   int64 = 64 << 20
+	replicationHeaderWait       = time.Minute
+)
+
+// replicationClient copies objects, which takes as long as their size
+// needs, so only the wait for responses is bounded.
+var replicationClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: replicationHeaderWait,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+// replicatedHeaders are the headers of an object copied along with it,
+// besides its user metadata.
+var replicatedHeaders = []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Content-Language", "Cache-Control", "Expires"}
+
+func replicationTargetID(bucket string) event.TargetID {
+	return event.TargetID{Service: replicationService, Name: bucket}
+}
+
+// replicationTarget replicates the objects of a bucket with the events of
+// their changes. The events go through the outbox, which retries failed
+// replications, and are delivered on workers of their own.
+type replicationTarget struct {
+	id             event.TargetID
+	replication    models.Replication
+	prefixes       []string
+	storageClasses map[string]string
+}
+
+func newReplicationTarget(r models.Replication) (*replicationTarget, error) {
+	t := &replicationTarget{
+		id:             replicationTargetID(r.Bucket),
+		replication:    r,
+		prefixes:       []string{},
+		storageClasses: map[string]string{},
+	}
+
+	if r.Prefixes != "" {
+		if err := json.Unmarshal([]byte(r.Prefixes), &t.prefixes); err != nil {
+			return nil, err
+		}
+	}
+	if r.StorageClasses != "" {
+		if err := json.Unmarshal([]byte(r.StorageClasses), &t.storageClasses); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *replicationTarget) ID() event.TargetID {
+	return t.id
+}
+
+func (t *replicationTarget) matches(key string) bool {
+	if len(t.prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range t.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *replicationTarget) Send(e event.Event) error {
+	key, err := url.QueryUnescape(e.S3.Object.Key)
+	if err != nil {
+		return err
+	}
+
+	operation, err := t.replicate(key)
+	saveReplicationStatus(t.replication.Bucket, key, func(status *models.ReplicationStatus) {
+		status.Operation = operation
+		if err != nil {
+			status.Status = models.ReplicationFailed
+			status.Attempts++
+			status.LastError = err.Error()
+			return
+		}
+
+		status.Status = models.ReplicationCompleted
+		status.Attempts = 0
+		status.LastError = ""
+	})
+
+	return err
+}
+
+// replicate brings an object on the destination up to date with the
+// bucket, no matter which event reported its change: the object is copied
+// while it is in the bucket and deleted once it is gone. Events delivered
+// late or again thus do no harm.
+func (t *replicationTarget) replicate(key string) (string, error) {
+	req, err := newBackendRequest("GET", t.replication.Bucket, key, nil, nil)
+	if err != nil {
+		return "copy", err
+	}
+
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return "copy", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return "copy", t.copyObject(key, resp)
+	case http.StatusNotFound:
+		return "delete", t.deleteObject(key)
+	}
+
+	return "copy", fmt.Errorf("GET %s/%s responded with %s", t.replication.Bucket, key, resp.Status)
+}
+
+func (t *replicationTarget) copyObject(key string, source *http.Response) error {
+	header := http.Header{}
+	for _, name := range replicatedHeaders {
+		if value := source.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	for name, values := range source.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			header[name] = values
+		}
+	}
+
+	storageClass := source.Header.Get("X-Amz-Storage-Class")
+	if storageClass == "" {
+		storageClass = "STANDARD"
+	}
+	if mapped, ok := t.storageClasses[storageClass]; ok {
+		storageClass = mapped
+	}
+	if storageClass != "STANDARD" {
+		header.Set("X-Amz-Storage-Class", storageClass)
+	}
+
+	if source.ContentLength > maxSinglePutSize {
+		return t.copyObjectInParts(key, source.Body, source.ContentLength, header)
+	}
+
+	resp, err := t.destinationRequest("PUT", key, nil, source.Body, source.ContentLength, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %s/%s responded with %s", t.replication.DestinationBucket, key, resp.Status)
+	}
+
+	return nil
+}
+
+// copyObjectInParts copies an object with a multipart upload, which is
+// aborted when any part fails.
+func (t *replicationTarget) copyObjectInParts(key string, body io.Reader, size int64, header http.Header) error {
+	resp, err := t.destinationRequest("POST", key, url.Values{"uploads": {""}}, nil, 0, header)
+	if err != nil {
+		return err
+	}
+	initiated := initiateMultipartUploadResult{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("initiating upload of %s/%s responded with %s", t.replication.DestinationBucket, key, resp.Status)
+	}
+	if err != nil {
+		return err
+	}
+
+	upload := url.Values{"uploadId": {initiated.UploadID}}
+	if err := t.uploadParts(key, upload, body, size); err != nil {
+		if resp, abortErr := t.destinationRequest("DELETE", key, upload, nil, 0, http.Header{}); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (t *replicationTarget) uploadParts(key string, upload url.Values, body io.Reader, size int64) error {
+	partSize := replicationPartSize
+	if minSize := (size + maxUploadParts - 1) / maxUploadParts; partSize < minSize {
+		partSize = minSize
+	}
+
+	parts := completeMultipartUpload{}
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+partSize {
+		length := partSize
+		if size-offset < length {
+			length = size - offset
+		}
+
+		query := url.Values{"uploadId": upload["uploadId"], "partNumber": {strconv.Itoa(n)}}
+		resp, err := t.destinationRequest("PUT", key, query, io.LimitReader(body, length), length, http.Header{})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("uploading part %d of %s/%s responded with %s", n, t.replication.DestinationBucket, key, resp.Status)
+		}
+
+		parts.Parts = append(parts.Parts, completePart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+	}
+
+	data, err := xml.Marshal(parts)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.destinationRequest("POST", key, upload, bytes.NewReader(data), int64(len(data)), http.Header{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Completing may fail after the response started, with an error in
+	// its body.
+	result, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || bytes.Contains(result, []byte("<Error>")) {
+		return fmt.Errorf("completing upload of %s/%s responded with %s: %s", t.replication.DestinationBucket, key, resp.Status, result)
+	}
+
+	return nil
+}
+
+func (t *replicationTarget) deleteObject(key string) error {
+	resp, err := t.destinationRequest("DELETE", key, nil, nil, 0, http.Header{})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+
+	return fmt.Errorf("DELETE %s/%s responded with %s", t.replication.DestinationBucket, key, resp.Status)
+}
+
+func (t *replicationTarget) destinationRequest(method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(t.replication.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + t.replication.DestinationBucket + "/" + key
+	u.RawQuery = query.Encode()
+
+	if body == nil || size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	req = s3signer.SignV4(*req, t.replication.AccessKey, t.replication.SecretKey, "", t.replication.Region)
+
+	return replicationClient.Do(req)
+}
+
+func (t *replicationTarget) Close() error {
+	return nil
+}
+
+// saveReplicationStatus changes the status of an object, which is created
+// with its first change.
+func saveReplicationStatus(bucket, key string, update func(*models.ReplicationStatus)) {
+	db := models.GetDB()
+	status := models.ReplicationStatus{}
+	db.Where(models.ReplicationStatus{Bucket: bucket, KeyHash: models.ReplicationKeyHash(key)}).FirstOrInit(&status)
+	status.Key = key
+	update(&status)
+
+	if err := db.Save(&status).Error; err != nil {
+		log.Printf("saving replication status of %s/%s failed: %v", bucket, key, err)
+	}
+}
+
+func markReplicationPending(bucket, key string) {
+	saveReplicationStatus(bucket, key, func(status *models.ReplicationStatus) {
+		status.Status = models.ReplicationPending
+	})
+}
+
+// replicationCache holds the replicated buckets, which requests look up to
+// decide whether their changes are replicated.
+type replicationCache struct {
+	sync.RWMutex
+	targets map[string]*replicationTarget
+}
+
+var replications = &replicationCache{targets: map[string]*replicationTarget{}}
+
+func (c *replicationCache) get(bucket string) *replicationTarget {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.targets[bucket]
+}
+
+// replicates reports whether a change of key is replicated, and to which
+// target.
+func (c *replicationCache) replicates(bucket, key string, eventType event.Name) (*replicationTarget, bool) {
+	if !isObjectChange(eventType) {
+		return nil, false
+	}
+
+	t := c.get(bucket)
+	if t == nil || !t.matches(key) {
+		return nil, false
+	}
+
+	return t, true
+}
+
+func addReplicationTarget(r models.Replication) {
+	id := replicationTargetID(r.Bucket)
+	if version, ok := targetVersions[id]; ok && version.Equal(r.UpdatedAt) {
+		return
+	}
+
+	t, err := newReplicationTarget(r)
+	if err != nil {
+		log.Printf("loading replication of %s failed: %v", r.Bucket, err)
+		return
+	}
+
+	removeTargets(id)
+	targetList.Add(t)
+	targetVersions[id] = r.UpdatedAt
+
+	replications.Lock()
+	replications.targets[r.Bucket] = t
+	replications.Unlock()
+}
+
+func removeReplicationTarget(bucket string) {
+	removeRegisteredTarget(replicationTargetID(bucket))
+
+	replications.Lock()
+	delete(replications.targets, bucket)
+	replications.Unlock()
+}
+
+func applyReplicationChange(bucket string) {
+	db := models.GetDB()
+	r := models.Replication{}
+	if db.Where("bucket = ?", bucket).First(&r).RecordNotFound() {
+		removeReplicationTarget(bucket)
+		return
+	}
+
+	addReplicationTarget(r)
+}
+
+func newReplicationResponse(r models.Replication) ReplicationResponse {
+	t, err := newReplicationTarget(r)
+	if err != nil {
+		t = &replicationTarget{}
+	}
+
+	return ReplicationResponse{
+		Bucket:            r.Bucket,
+		Endpoint:          redactEndpoint(r.Endpoint),
+		Region:            r.Region,
+		DestinationBucket: r.DestinationBucket,
+		AccessKey:         r.AccessKey,
+		Prefixes:          t.prefixes,
+		StorageClasses:    t.storageClasses,
+	}
+}
+
+// ListReplications lists the replicated buckets. Secret keys are never
+// returned.
+func ListReplications(c *gin.Context) {
+	if !authenticateAdmin(c) {
+		return
+	}
+
+	db := models.GetDB()
+	rs := []models.Replication{}
+	db.Order("bucket").Find(&rs)
+
+	body := ReplicationsResponse{Replications: []ReplicationResponse{}}
+	for _, r := range rs {
+		body.Replications = append(body.Replications, newReplicationResponse(r))
+	}
+
+	c.JSON(http.StatusOK, body)
+}
+
+// PutReplication replicates a bucket, or changes where to. Objects already
+// in the bucket are replicated with their next change.
+func PutReplication(c *gin.Context) {
+	if !authenticateAdmin(c) {
+		return
+	}
+
+	bucket := c.Param("bucket")
+	if _, err := getBucketOwner(bucket); err != nil {
+		c.String(http.StatusNotFound, "reading bucket %s failed: %v", bucket, err)
+		return
+	}
+
+	input := ReplicationRequest{}
+	if err := json.NewDecoder(c.Request.Body).Decode(&input); err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(input.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.String(http.StatusBadRequest, "endpoint must be an http or https URL")
+		return
+	}
+	if input.DestinationBucket == "" {
+		input.DestinationBucket = bucket
+	}
+	if input.Region == "" {
+		input.Region = config.GetServerConfig().Region
+	}
+
+	if input.Prefixes == nil {
+		input.Prefixes = []string{}
+	}
+	if input.StorageClasses == nil {
+		input.StorageClasses = map[string]string{}
+	}
+	prefixes, _ := json.Marshal(input.Prefixes)
+	storageClasses, _ := json.Marshal(input.StorageClasses)
+
+	db := models.GetDB()
+	r := models.Replication{}
+	db.Where("bucket = ?", bucket).First(&r)
+	r.Bucket = bucket
+	r.Endpoint = input.Endpoint
+	r.Region = input.Region
+	r.DestinationBucket = input.DestinationBucket
+	r.AccessKey = input.AccessKey
+	r.SecretKey = input.SecretKey
+	r.Prefixes = string(prefixes)
+	r.StorageClasses = string(storageClasses)
+	if err := db.Save(&r).Error; err != nil {
+		log.Printf("saving replication of %s failed: %v", bucket, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, newReplicationResponse(r))
+}
+
+// DeleteReplication stops replicating a bucket. The copies made so far stay
+// on the destination.
+func DeleteReplication(c *gin.Context) {
+	if !authenticateAdmin(c) {
+		return
+	}
+
+	db := models.GetDB()
+	r := models.Replication{}
+	if db.Where("bucket = ?", c.Param("bucket")).First(&r).RecordNotFound() {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	db.Unscoped().Delete(&r)
+	c.Status(http.StatusNoContent)
+}
+
+// GetReplicationStatus counts the objects of a bucket by their replication
+// status, and lists the latest changed objects, of one status when asked.
+func GetReplicationStatus(c *gin.Context) {
+	if !authenticateAdmin(c) {
+		return
+	}
+
+	bucket := c.Param("bucket")
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > maxStatusesListed {
+		limit = maxStatusesListed
+	}
+
+	db := models.GetDB()
+	body := ReplicationStatusResponse{
+		Bucket:  bucket,
+		Counts:  map[string]int{},
+		Objects: []ReplicationObject{},
+	}
+
+	rows, err := db.Model(&models.ReplicationStatus{}).Select("status, count(*)").Where("bucket = ?", bucket).Group("status").Rows()
+	if err != nil {
+		log.Printf("counting replication statuses of %s failed: %v", bucket, err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var count int
+		rows.Scan(&status, &count)
+		body.Counts[status] = count
+	}
+
+	query := db.Where("bucket = ?", bucket)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	statuses := []models.ReplicationStatus{}
+	query.Order("updated_at desc").Limit(limit).Find(&statuses)
+
+	for _, status := range statuses {
+		body.Objects = append(body.Objects, ReplicationObject{
+			Key:       status.Key,
+			Operation: status.Operation,
+			Status:    status.Status,
+			Attempts:  status.Attempts,
+			LastError: status.LastError,
+			UpdatedAt: status.UpdatedAt.UTC().Format(event.AMZTimeFormat),
+		})
+	}
+
+	c.JSON(http.StatusOK, body)
+}
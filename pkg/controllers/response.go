@@ -15,10 +15,13 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package controllers
 
 import (
+	"encoding/json"
 	"encoding/xml"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minio/minio/cmd"
+	"github.com/satori/go.uuid"
 )
 
 type ListQueuesResponse struct {
@@ -105,8 +108,275 @@ type UnsubscribeResponse struct {
 	RequestID string   `xml:"ResponseMetadata>RequestId"`
 }
 
+type ConfirmSubscriptionResponse struct {
+	XMLName         xml.Name `xml:"ConfirmSubscriptionResponse"`
+	SubscriptionARN string   `xml:"ConfirmSubscriptionResult>SubscriptionArn"`
+	RequestID       string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type Attribute struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type GetTopicAttributesResponse struct {
+	XMLName    xml.Name    `xml:"GetTopicAttributesResponse"`
+	Attributes []Attribute `xml:"GetTopicAttributesResult>Attributes>entry"`
+	RequestID  string      `xml:"ResponseMetadata>RequestId"`
+}
+
+type SetTopicAttributesResponse struct {
+	XMLName   xml.Name `xml:"SetTopicAttributesResponse"`
+	RequestID string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type GetSubscriptionAttributesResponse struct {
+	XMLName    xml.Name    `xml:"GetSubscriptionAttributesResponse"`
+	Attributes []Attribute `xml:"GetSubscriptionAttributesResult>Attributes>entry"`
+	RequestID  string      `xml:"ResponseMetadata>RequestId"`
+}
+
+type SetSubscriptionAttributesResponse struct {
+	XMLName   xml.Name `xml:"SetSubscriptionAttributesResponse"`
+	RequestID string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type RedriveDeadLettersResponse struct {
+	XMLName   xml.Name `xml:"RedriveDeadLettersResponse"`
+	Pending   int64    `xml:"RedriveDeadLettersResult>Pending"`
+	RequestID string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type AddPermissionResponse struct {
+	XMLName   xml.Name `xml:"AddPermissionResponse"`
+	RequestID string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type RemovePermissionResponse struct {
+	XMLName   xml.Name `xml:"RemovePermissionResponse"`
+	RequestID string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type PublishResponse struct {
+	XMLName        xml.Name `xml:"PublishResponse"`
+	MessageID      string   `xml:"PublishResult>MessageId"`
+	SequenceNumber string   `xml:"PublishResult>SequenceNumber,omitempty"`
+	RequestID      string   `xml:"ResponseMetadata>RequestId"`
+}
+
+type PublishBatchResultEntry struct {
+	ID             string `xml:"Id"`
+	MessageID      string `xml:"MessageId"`
+	SequenceNumber string `xml:"SequenceNumber,omitempty"`
+}
+
+type BatchResultErrorEntry struct {
+	ID          string `xml:"Id"`
+	Code        string `xml:"Code"`
+	Message     string `xml:"Message"`
+	SenderFault bool   `xml:"SenderFault"`
+}
+
+type PublishBatchResponse struct {
+	XMLName    xml.Name                  `xml:"PublishBatchResponse"`
+	Successful []PublishBatchResultEntry `xml:"PublishBatchResult>Successful>member"`
+	Failed     []BatchResultErrorEntry   `xml:"PublishBatchResult>Failed>member"`
+	RequestID  string                    `xml:"ResponseMetadata>RequestId"`
+}
+
 func writeErrorResponse(c *gin.Context, errorCode cmd.APIErrorCode) {
 	apiError := cmd.GetAPIError(errorCode)
 	errorResponse := cmd.GetAPIErrorResponse(apiError, c.Request.URL.Path)
 	c.XML(apiError.HTTPStatusCode, errorResponse)
 }
+
+func writeSenderErrorResponse(c *gin.Context, statusCode int, code, message string) {
+	requestID, _ := uuid.NewV4()
+	body := ErrorResponse{
+		Type:      "Sender",
+		Code:      code,
+		Message:   message,
+		RequestID: requestID.String(),
+	}
+	c.XML(statusCode, body)
+}
+
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type AccessControlPolicy struct {
+	XMLName xml.Name `xml:"AccessControlPolicy"`
+	Owner   struct {
+		ID          string `xml:"ID"`
+		DisplayName string `xml:"DisplayName"`
+	} `xml:"Owner"`
+}
+
+type DeletedObject struct {
+	Key                   string `xml:"Key"`
+	VersionID             string `xml:"VersionId"`
+	DeleteMarker          bool   `xml:"DeleteMarker"`
+	DeleteMarkerVersionID string `xml:"DeleteMarkerVersionId"`
+}
+
+type DeleteRequest struct {
+	XMLName xml.Name        `xml:"Delete"`
+	Quiet   bool            `xml:"Quiet"`
+	Objects []DeletedObject `xml:"Object"`
+}
+
+type DeleteError struct {
+	Key       string `xml:"Key"`
+	VersionID string `xml:"VersionId"`
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+}
+
+type DeleteResult struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Deleted []DeletedObject `xml:"Deleted"`
+	Errors  []DeleteError   `xml:"Error"`
+}
+
+type VersioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Status  string   `xml:"Status"`
+}
+
+type FailedEvent struct {
+	ID        uint            `json:"id"`
+	Target    string          `json:"target"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError"`
+	FailedAt  string          `json:"failedAt"`
+	Event     json.RawMessage `json:"event"`
+}
+
+type FailedEventsResponse struct {
+	FailedEvents []FailedEvent `json:"failedEvents"`
+}
+
+type ReplayRequest struct {
+	Bucket string    `json:"bucket"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Events []string  `json:"events"`
+	Target string    `json:"target"`
+	After  uint      `json:"after"`
+}
+
+type ReplayResponse struct {
+	Replayed int  `json:"replayed"`
+	LastID   uint `json:"lastId"`
+}
+
+type TargetRequest struct {
+	Endpoint      string `json:"endpoint"`
+	AuthHeader    string `json:"authHeader"`
+	PayloadFormat string `json:"payloadFormat"`
+}
+
+type TargetResponse struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	ARN           string `json:"arn"`
+	Endpoint      string `json:"endpoint"`
+	PayloadFormat string `json:"payloadFormat,omitempty"`
+}
+
+type TargetsResponse struct {
+	Targets []TargetResponse `json:"targets"`
+}
+
+type EventRuleRequest struct {
+	Pattern json.RawMessage `json:"pattern"`
+	Targets []string        `json:"targets"`
+}
+
+type EventRuleResponse struct {
+	Name    string          `json:"name"`
+	Pattern json.RawMessage `json:"pattern"`
+	Targets []string        `json:"targets"`
+}
+
+type EventRulesResponse struct {
+	Rules []EventRuleResponse `json:"rules"`
+}
+
+type FunctionRequest struct {
+	URL         string `json:"url"`
+	AuthHeader  string `json:"authHeader"`
+	Timeout     int    `json:"timeout"`
+	Concurrency int    `json:"concurrency"`
+}
+
+type FunctionResponse struct {
+	ARN         string `json:"arn"`
+	URL         string `json:"url"`
+	Timeout     int    `json:"timeout"`
+	Concurrency int    `json:"concurrency"`
+}
+
+type FunctionsResponse struct {
+	Functions []FunctionResponse `json:"functions"`
+}
+
+type FunctionInvocation struct {
+	ID         uint    `json:"id"`
+	EventName  string  `json:"eventName"`
+	Bucket     string  `json:"bucket"`
+	Key        string  `json:"key"`
+	Status     string  `json:"status"`
+	StatusCode int     `json:"statusCode,omitempty"`
+	Duration   float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+	InvokedAt  string  `json:"invokedAt"`
+}
+
+type FunctionInvocationsResponse struct {
+	Invocations []FunctionInvocation `json:"invocations"`
+}
+
+type ReplicationRequest struct {
+	Endpoint          string            `json:"endpoint"`
+	Region            string            `json:"region"`
+	DestinationBucket string            `json:"destinationBucket"`
+	AccessKey         string            `json:"accessKey"`
+	SecretKey         string            `json:"secretKey"`
+	Prefixes          []string          `json:"prefixes"`
+	StorageClasses    map[string]string `json:"storageClasses"`
+}
+
+type ReplicationResponse struct {
+	Bucket            string            `json:"bucket"`
+	Endpoint          string            `json:"endpoint"`
+	Region            string            `json:"region"`
+	DestinationBucket string            `json:"destinationBucket"`
+	AccessKey         string            `json:"accessKey"`
+	Prefixes          []string          `json:"prefixes"`
+	StorageClasses    map[string]string `json:"storageClasses"`
+}
+
+type ReplicationsResponse struct {
+	Replications []ReplicationResponse `json:"replications"`
+}
+
+type ReplicationObject struct {
+	Key       string `json:"key"`
+	Operation string `json:"operation"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError,omitempty"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+type ReplicationStatusResponse struct {
+	Bucket  string              `json:"bucket"`
+	Counts  map[string]int      `json:"counts"`
+	Objects []ReplicationObject `json:"objects"`
+}
@@ -0,0 +1,365 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+const (
+	logSourceLockKey = "kaoliang:logsource"
+	datalogMarker    = "datalog"
+	logListLimit     = 1000
+	logDateFormat    = "2006-01-02 15:04:05"
+)
+
+// wasProxiedScript takes back one of the events the proxy counted for a
+// key, and tells whether there was one.
+const wasProxiedScript = `
+local n = tonumber(redis.call("GET", KEYS[1]) or "0")
+if n > 0 then
+	redis.call("DECR", KEYS[1])
+	return 1
+end
+return 0`
+
+// radosgwAdmin runs the admin command of RGW and returns what it printed.
+var radosgwAdmin = func(args ...string) ([]byte, error) {
+	out, err := exec.Command(config.GetServerConfig().RGW.AdminCommand, args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("radosgw-admin %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+
+	return out, err
+}
+
+// datalogEntry names a bucket changed in the data log, as
+// "bucket:instance".
+type datalogEntry struct {
+	Entry struct {
+		Key       string `json:"key"`
+		Timestamp string `json:"timestamp"`
+	} `json:"entry"`
+}
+
+// bilogEntry is an operation on an object in the index log of a bucket.
+type bilogEntry struct {
+	OpID      string `json:"op_id"`
+	Op        string `json:"op"`
+	Object    string `json:"object"`
+	Instance  string `json:"instance"`
+	State     string `json:"state"`
+	Timestamp string `json:"timestamp"`
+	Versioned bool   `json:"versioned"`
+	Owner     string `json:"owner"`
+}
+
+func parseLogTime(s string) (time.Time, error) {
+	s = strings.TrimSuffix(s, "Z")
+	if t, err := time.Parse("2006-01-02 15:04:05.999999999", s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// bilogEventName is the event an entry of the index log reports. Writes to
+// versioned buckets are logged for the instance and again when it becomes
+// current, only the latter is reported.
+func bilogEventName(e bilogEntry) (event.Name, bool) {
+	if e.State != "complete" {
+		return 0, false
+	}
+
+	switch e.Op {
+	case "write":
+		return event.ObjectCreatedPut, !e.Versioned
+	case "link_olh":
+		return event.ObjectCreatedPut, true
+	case "link_olh_del":
+		return event.ObjectRemovedDeleteMarkerCreated, true
+	case "del":
+		return event.ObjectRemovedDelete, !e.Versioned
+	case "unlink_instance":
+		return event.ObjectRemovedDelete, true
+	}
+
+	return 0, false
+}
+
+// advanceBilogMarker moves the marker of a bucket past an entry. Entries
+// of sharded buckets are named "shard#id", and the marker keeps one id per
+// shard, joined by commas.
+func advanceBilogMarker(marker, opID string) string {
+	i := strings.Index(opID, "#")
+	if i < 0 {
+		return opID
+	}
+
+	shard := opID[:i+1]
+	markers := []string{}
+	found := false
+	for _, m := range strings.Split(marker, ",") {
+		if m == "" || !strings.Contains(m, "#") {
+			continue
+		}
+		if strings.HasPrefix(m, shard) {
+			m = opID
+			found = true
+		}
+		markers = append(markers, m)
+	}
+	if !found {
+		markers = append(markers, opID)
+	}
+
+	return strings.Join(markers, ",")
+}
+
+func proxiedEventKey(bucket, key string, eventType event.Name) string {
+	category := strings.SplitN(eventType.String(), ":", 3)[1]
+	return fmt.Sprintf("events:proxied:%s:%s/%s", category, bucket, key)
+}
+
+func isObjectChange(eventType event.Name) bool {
+	name := eventType.String()
+	return strings.HasPrefix(name, "s3:ObjectCreated:") || strings.HasPrefix(name, "s3:ObjectRemoved:")
+}
+
+// markProxied counts an event the proxy sent, so the same change is not
+// sent again when it is read from the index log within the dedup window.
+func markProxied(bucket, key string, eventType event.Name) {
+	client := models.GetCache()
+	if client == nil || !isObjectChange(eventType) {
+		return
+	}
+
+	k := proxiedEventKey(bucket, key, eventType)
+	pipe := client.TxPipeline()
+	pipe.Incr(k)
+	pipe.Expire(k, config.GetServerConfig().RGW.DedupWindow)
+	if _, err := pipe.Exec(); err != nil {
+		log.Printf("marking event for %s/%s failed: %v", bucket, key, err)
+	}
+}
+
+func wasProxied(bucket, key string, eventType event.Name) bool {
+	client := models.GetCache()
+	n, err := client.Eval(wasProxiedScript, []string{proxiedEventKey(bucket, key, eventType)}).Result()
+	if err != nil {
+		log.Printf("checking event for %s/%s failed: %v", bucket, key, err)
+		return false
+	}
+
+	return n == int64(1)
+}
+
+// StartLogSource follows the data log and the bucket index logs of RGW
+// for writes that did not go through kaoliang, e.g. those of NFS exports.
+// One process at a time follows the logs.
+func StartLogSource() {
+	interval := config.GetServerConfig().RGW.LogPollInterval
+	if interval <= 0 {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	lock := &logSourceLock{redisLock{
+		key:   logSourceLockKey,
+		owner: fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		ttl:   3 * interval,
+	}}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if lock.hold() {
+				followRGWLogs(lock)
+			}
+		}
+	}()
+}
+
+// logSourceLock makes one process at a time follow the logs. The process
+// holding it renews it for each batch of entries it lists, and stops
+// following the logs as soon as it fails to.
+type logSourceLock struct {
+	redisLock
+}
+
+func (l *logSourceLock) hold() bool {
+	ok, err := l.renew()
+	if err == nil && !ok {
+		ok, err = l.acquire()
+	}
+	if err != nil {
+		log.Printf("locking the RGW logs failed: %v", err)
+		return false
+	}
+
+	return ok
+}
+
+// followRGWLogs reads the buckets changed since the last poll from the data
+// log, and the changes to their objects from their index logs. The data log
+// is listed by time, overlapping the previous poll by up to a second, the
+// index logs from where they were left.
+func followRGWLogs(lock *logSourceLock) {
+	db := models.GetDB()
+	cursor := models.LogMarker{Name: datalogMarker}
+	since := time.Now().UTC()
+	if !db.Where("name = ?", datalogMarker).First(&cursor).RecordNotFound() {
+		if t, err := time.Parse(logDateFormat, cursor.Marker); err == nil {
+			since = t
+		}
+	}
+
+	if window := config.GetServerConfig().RGW.DedupWindow; time.Since(since) > window {
+		log.Printf("the RGW logs are read %v behind, beyond the dedup window of %v; writes through kaoliang may be reported twice", time.Since(since), window)
+	}
+
+	out, err := radosgwAdmin("datalog", "list", "--extra-info=true", "--start-date="+since.Format(logDateFormat))
+	if err != nil {
+		log.Printf("listing the data log failed: %v", err)
+		return
+	}
+
+	entries := []datalogEntry{}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		log.Printf("reading the data log failed: %v", err)
+		return
+	}
+
+	latest := since
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if t, err := parseLogTime(e.Entry.Timestamp); err == nil && t.After(latest) {
+			latest = t
+		}
+
+		bucket := strings.SplitN(e.Entry.Key, ":", 2)[0]
+		if seen[bucket] {
+			continue
+		}
+		seen[bucket] = true
+
+		if err := followBucketLog(bucket, since, lock); err != nil {
+			log.Printf("following the index log of %s failed: %v", bucket, err)
+			return
+		}
+	}
+
+	cursor.Marker = latest.Format(logDateFormat)
+	if err := db.Save(&cursor).Error; err != nil {
+		log.Printf("saving the data log marker failed: %v", err)
+	}
+}
+
+// followBucketLog sends the events of the entries in the index log of a
+// bucket past its marker. The log of a bucket seen for the first time is
+// read from since.
+func followBucketLog(bucket string, since time.Time, lock *logSourceLock) error {
+	db := models.GetDB()
+	name := "bilog:" + bucket
+	cursor := models.LogMarker{Name: name}
+	known := !db.Where("name = ?", name).First(&cursor).RecordNotFound()
+
+	for {
+		if !lock.hold() {
+			return errors.New("lost the lock of the RGW logs")
+		}
+
+		args := []string{"bilog", "list", "--bucket=" + bucket, "--max-entries=" + strconv.Itoa(logListLimit)}
+		if cursor.Marker != "" {
+			args = append(args, "--marker="+cursor.Marker)
+		}
+
+		out, err := radosgwAdmin(args...)
+		if err != nil {
+			return err
+		}
+
+		entries := []bilogEntry{}
+		if err := json.Unmarshal(out, &entries); err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			cursor.Marker = advanceBilogMarker(cursor.Marker, e.OpID)
+			if t, err := parseLogTime(e.Timestamp); !known && err == nil && t.Before(since) {
+				continue
+			}
+
+			sendLoggedEvent(bucket, e)
+		}
+
+		if err := db.Save(&cursor).Error; err != nil {
+			return err
+		}
+		known = true
+
+		if len(entries) < logListLimit {
+			return nil
+		}
+	}
+}
+
+// sendLoggedEvent sends the event of an index log entry, unless the proxy
+// already sent it.
+func sendLoggedEvent(bucket string, e bilogEntry) {
+	eventType, ok := bilogEventName(e)
+	if !ok {
+		return
+	}
+
+	match := matchObject(bucket, e.Object, eventType)
+	if match == nil || wasProxied(bucket, eventKey(e.Object), eventType) {
+		return
+	}
+
+	object := event.Object{Key: eventKey(e.Object), VersionID: e.Instance}
+	if eventType == event.ObjectCreatedPut {
+		object = statObject(bucket, e.Object, e.Instance)
+	}
+
+	r := &eventRequest{
+		principal:        e.Owner,
+		logged:           true,
+		responseElements: map[string]string{},
+	}
+
+	owner, err := getBucketOwner(bucket)
+	if err != nil {
+		log.Printf("reading owner of %s failed: %v", bucket, err)
+	}
+	r.owner = owner
+
+	r.dispatch(eventType, match, object)
+}
@@ -0,0 +1,189 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+// notificationChannel carries the names of buckets whose notification
+// configuration was put, so every proxy drops its compiled rules.
+const notificationChannel = "notifications"
+
+// rulesCacheTTL bounds how long a proxy may keep stale rules when an
+// invalidation was lost.
+const rulesCacheTTL = 5 * time.Minute
+
+// maxCachedBuckets bounds the number of buckets whose rules are cached.
+const maxCachedBuckets = 10000
+
+// bucketNotification is the compiled notification configuration of a
+// bucket, with the id of the configuration each target was added by.
+type bucketNotification struct {
+	rules     event.RulesMap
+	configIDs map[event.TargetID]string
+}
+
+func newBucketNotification(nConfig *event.Config) *bucketNotification {
+	notification := &bucketNotification{
+		rules:     nConfig.ToRulesMap(),
+		configIDs: map[event.TargetID]string{},
+	}
+
+	for _, queue := range nConfig.QueueList {
+		if _, ok := notification.configIDs[queue.ARN.TargetID]; !ok {
+			notification.configIDs[queue.ARN.TargetID] = queue.ID
+		}
+	}
+	for _, topic := range nConfig.TopicList {
+		if _, ok := notification.configIDs[topic.ARN.TargetID]; !ok {
+			notification.configIDs[topic.ARN.TargetID] = topic.ID
+		}
+	}
+	for _, lambda := range nConfig.LambdaList {
+		if _, ok := notification.configIDs[lambda.ARN.TargetID]; !ok {
+			notification.configIDs[lambda.ARN.TargetID] = lambda.ID
+		}
+	}
+
+	return notification
+}
+
+// rulesCache holds the compiled notification configuration of the most
+// recently used buckets. Buckets without a configuration are cached with
+// empty rules, so events for them are dropped with a single map lookup;
+// the size bound keeps requests for made-up bucket names from growing it.
+type rulesCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cachedRules struct {
+	bucket       string
+	notification *bucketNotification
+}
+
+var bucketRules = newRulesCache(maxCachedBuckets)
+
+func newRulesCache(size int) *rulesCache {
+	return &rulesCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (c *rulesCache) get(bucket string) (*bucketNotification, error) {
+	c.Lock()
+	if element, ok := c.entries[bucket]; ok {
+		c.order.MoveToFront(element)
+		c.Unlock()
+		return element.Value.(*cachedRules).notification, nil
+	}
+	c.Unlock()
+
+	// Only a missing configuration is cached, other errors are retried by
+	// the next event.
+	nConfig, err := readNotificationConfig(targetList, bucket)
+	var notification *bucketNotification
+	switch {
+	case err == errNoSuchNotifications:
+		notification = &bucketNotification{rules: event.RulesMap{}}
+	case err != nil:
+		return nil, err
+	default:
+		notification = newBucketNotification(nConfig)
+	}
+
+	c.put(bucket, notification)
+	return notification, nil
+}
+
+func (c *rulesCache) put(bucket string, notification *bucketNotification) {
+	c.Lock()
+	defer c.Unlock()
+
+	if element, ok := c.entries[bucket]; ok {
+		element.Value.(*cachedRules).notification = notification
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[bucket] = c.order.PushFront(&cachedRules{bucket, notification})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedRules).bucket)
+	}
+}
+
+func (c *rulesCache) invalidate(bucket string) {
+	c.Lock()
+	if element, ok := c.entries[bucket]; ok {
+		c.order.Remove(element)
+		delete(c.entries, bucket)
+	}
+	c.Unlock()
+}
+
+func (c *rulesCache) reset() {
+	c.Lock()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+	c.Unlock()
+}
+
+func invalidateBucketRules(bucket string) {
+	bucketRules.invalidate(bucket)
+
+	client := models.GetCache()
+	if err := client.Publish(notificationChannel, bucket).Err(); err != nil {
+		log.Printf("announcing notification change of %s failed: %v", bucket, err)
+	}
+}
+
+// SetRulesCache drops the cached rules of a bucket whenever any proxy puts
+// its notification configuration.
+func SetRulesCache() {
+	client := models.GetCache()
+	pubsub := client.Subscribe(notificationChannel)
+	if _, err := pubsub.Receive(); err != nil {
+		log.Fatalf("subscribing to %s failed: %v", notificationChannel, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(rulesCacheTTL)
+		defer ticker.Stop()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case msg := <-messages:
+				bucketRules.invalidate(msg.Payload)
+			case <-ticker.C:
+				bucketRules.reset()
+			}
+		}
+	}()
+}
@@ -0,0 +1,220 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio/pkg/event"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+const benchmarkConfig = `<NotificationConfiguration>
+	<QueueConfiguration>
+		<Id>1</Id>
+		<Filter><S3Key><FilterRule><Name>prefix</Name><Value>logs/</Value></FilterRule></S3Key></Filter>
+		<Queue>arn:aws:sqs:us-east-1:tester:kaoliang</Queue>
+		<Event>s3:ObjectCreated:Put</Event>
+	</QueueConfiguration>
+</NotificationConfiguration>`
+
+func newPutResponse(path string) *http.Response {
+	req, _ := http.NewRequest("PUT", "http://localhost"+path, nil)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Etag": {`"d41d8cd98f00b204e9800998ecf8427e"`}},
+		Request:    req,
+	}
+}
+
+func setBenchmarkRules(tb testing.TB) {
+	config.SetServerConfig()
+	targetList = event.NewTargetList()
+	targetList.Add(resourceTarget{id: event.TargetID{Service: "sqs", ID: "tester", Name: "kaoliang"}})
+
+	nConfig, err := event.ParseConfig(strings.NewReader(benchmarkConfig), "us-east-1", targetList)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	bucketRules.reset()
+	bucketRules.put("empty", &bucketNotification{rules: event.RulesMap{}})
+	bucketRules.put("configured", newBucketNotification(nConfig))
+}
+
+func TestSendEventWithoutConfig(t *testing.T) {
+	setBenchmarkRules(t)
+
+	Convey("Given a bucket without notification config", t, func() {
+		resp := newPutResponse("/empty/object")
+
+		Convey("Sending an event should do nothing", func() {
+			So(func() { sendEvent(resp, event.ObjectCreatedPut) }, ShouldNotPanic)
+			So(sendEvent(resp, event.ObjectCreatedPut), ShouldBeNil)
+		})
+	})
+}
+
+func TestRulesCacheBound(t *testing.T) {
+	Convey("Given a rules cache of two buckets", t, func() {
+		cache := newRulesCache(2)
+		cache.put("first", &bucketNotification{rules: event.RulesMap{}})
+		cache.put("second", &bucketNotification{rules: event.RulesMap{}})
+		cache.get("first")
+
+		Convey("Adding a third bucket should evict the least recently used one", func() {
+			cache.put("third", &bucketNotification{rules: event.RulesMap{}})
+			So(cache.order.Len(), ShouldEqual, 2)
+			So(cache.entries, ShouldContainKey, "first")
+			So(cache.entries, ShouldContainKey, "third")
+			So(cache.entries, ShouldNotContainKey, "second")
+		})
+	})
+}
+
+func BenchmarkSendEventWithoutConfig(b *testing.B) {
+	setBenchmarkRules(b)
+	resp := newPutResponse("/empty/object")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sendEvent(resp, event.ObjectCreatedPut)
+	}
+}
+
+func BenchmarkSendEventWithoutMatchingRule(b *testing.B) {
+	setBenchmarkRules(b)
+	resp := newPutResponse("/configured/data")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sendEvent(resp, event.ObjectCreatedPut)
+	}
+}
+
+func BenchmarkSendAccessEventWithoutAccessRule(b *testing.B) {
+	setBenchmarkRules(b)
+	resp := newPutResponse("/configured/logs/data")
+	resp.Request.Method = "GET"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sendAccessEvent(resp, event.ObjectAccessedGet)
+	}
+}
+
+// BenchmarkParseNotificationConfig is what every upload used to pay before
+// the rules were cached.
+func BenchmarkParseNotificationConfig(b *testing.B) {
+	setBenchmarkRules(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nConfig, _ := event.ParseConfig(strings.NewReader(benchmarkConfig), "us-east-1", targetList)
+		nConfig.ToRulesMap()
+	}
+}
+
+func TestEventRules(t *testing.T) {
+	newEvent := event.Event{
+		EventName: event.ObjectCreatedPut,
+		UserIdentity: event.Identity{
+			PrincipalID: "uploader",
+		},
+		RequestParameters: map[string]string{
+			"sourceIPAddress": "10.1.2.3",
+		},
+	}
+	newEvent.S3.Bucket.Name = "bucket"
+	newEvent.S3.Object = event.Object{
+		Key:          "images/cat.jpg",
+		Size:         2048,
+		ContentType:  "image/jpeg",
+		UserMetadata: map[string]string{"X-Amz-Meta-Project": "zoo"},
+	}
+
+	compile := func(pattern string) *eventRule {
+		p, err := compileEventPattern([]byte(pattern))
+		So(err, ShouldBeNil)
+		return &eventRule{name: pattern, pattern: p, targetIDs: []event.TargetID{{Service: "sqs", ID: "tester", Name: pattern}}}
+	}
+
+	Convey("Given an object created event", t, func() {
+		cases := []struct {
+			pattern string
+			matched bool
+		}{
+			{`{"eventName": ["s3:ObjectCreated:Put"]}`, true},
+			{`{"eventName": ["s3:ObjectRemoved:Delete"]}`, false},
+			{`{"s3": {"object": {"size": [{"numeric": [">", 1024, "<=", 4096]}]}}}`, true},
+			{`{"s3": {"object": {"size": [{"numeric": [">", 4096]}]}}}`, false},
+			{`{"s3": {"object": {"contentType": [{"prefix": "image/"}]}}}`, true},
+			{`{"s3": {"object": {"userMetadata": {"X-Amz-Meta-Project": ["zoo"]}}}}`, true},
+			{`{"s3": {"object": {"versionId": [{"exists": false}]}}}`, true},
+			{`{"userIdentity": {"principalId": [{"anything-but": ["uploader", "admin"]}]}}`, false},
+			{`{"requestParameters": {"sourceIPAddress": [{"cidr": "10.0.0.0/8"}]}}`, true},
+			{`{"requestParameters": {"sourceIPAddress": [{"cidr": "192.168.0.0/16"}]}}`, false},
+			{`{"s3": {"bucket": {"name": ["other"]}, "object": {"key": [{"suffix": ".jpg"}]}}}`, false},
+		}
+
+		for _, c := range cases {
+			targets := matchEventRules([]*eventRule{compile(c.pattern)}, newEvent)
+			So(len(targets) == 1, ShouldEqual, c.matched)
+		}
+	})
+
+	Convey("Rules should be indexed by the event names they can match", t, func() {
+		compiled := compileEventRules([]models.EventRule{
+			{AccountID: "tester", Name: "created", Pattern: `{"eventName": [{"prefix": "s3:ObjectCreated:"}]}`, Targets: `[]`},
+			{AccountID: "tester", Name: "large", Pattern: `{"s3": {"object": {"size": [{"numeric": [">", 4096]}]}}}`, Targets: `[]`},
+		})
+
+		So(compiled["tester"][event.ObjectCreatedPut], ShouldHaveLength, 2)
+		So(compiled["tester"][event.ObjectAccessedGet], ShouldHaveLength, 1)
+		So(compiled["tester"][event.ObjectAccessedGet][0].name, ShouldEqual, "large")
+	})
+
+	Convey("Rules of accounts should only apply to the buckets they own", t, func() {
+		cache := &eventRuleCache{
+			rules: compileEventRules([]models.EventRule{
+				{AccountID: "tester", Name: "accessed", Pattern: `{"eventName": [{"prefix": "s3:ObjectAccessed:"}]}`, Targets: `[]`},
+			}),
+			owners: map[string]string{},
+		}
+		cache.setBuckets("tester", []string{"photos"})
+
+		So(cache.getByBucket("photos", event.ObjectAccessedGet), ShouldHaveLength, 1)
+		So(cache.getByBucket("other", event.ObjectAccessedGet), ShouldBeEmpty)
+
+		cache.setBuckets("tester", nil)
+		So(cache.getByBucket("photos", event.ObjectAccessedGet), ShouldBeEmpty)
+	})
+
+	Convey("Invalid patterns should be rejected", t, func() {
+		for _, pattern := range []string{`[]`, `{}`, `{"eventName": "s3:ObjectCreated:Put"}`, `{"s3": {"object": {"size": [{"numeric": ["~", 1]}]}}}`, `{"eventName": [{"regex": "."}]}`} {
+			_, err := compileEventPattern([]byte(pattern))
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/minio/minio/pkg/event"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+)
+
+// targetReloadInterval bounds how long the target list may miss a change
+// whose announcement was lost, e.g. while redis was reconnecting.
+const targetReloadInterval = time.Minute
+
+var targetList = event.NewTargetList()
+
+// resourceTarget is a kaoliang queue or topic that bucket events can be
+// sent to.
+type resourceTarget struct {
+	id     event.TargetID
+	format string
+}
+
+func newResourceTarget(resource models.Resource) resourceTarget {
+	id := event.TargetID{
+		Service: resource.Service.String(),
+		ID:      resource.AccountID,
+		Name:    resource.Name,
+	}
+
+	return resourceTarget{id: id, format: resource.PayloadFormat}
+}
+
+func (t resourceTarget) ID() event.TargetID {
+	return t.id
+}
+
+func (t resourceTarget) Send(e event.Event) error {
+	return sendToTarget(t.id, t.format, e)
+}
+
+func (t resourceTarget) Close() error {
+	return nil
+}
+
+func addTarget(resource models.Resource) {
+	target := newResourceTarget(resource)
+	if !targetList.Exists(target.ID()) {
+		targetList.Add(target)
+	}
+}
+
+func removeTargets(ids ...event.TargetID) {
+	for range targetList.Remove(ids...) {
+	}
+}
+
+func reloadTargets() error {
+	db := models.GetDB()
+	resources := []models.Resource{}
+	if err := db.Find(&resources).Error; err != nil {
+		return err
+	}
+
+	registered := []models.Target{}
+	if err := db.Find(&registered).Error; err != nil {
+		return err
+	}
+
+	functions := []models.Function{}
+	if err := db.Find(&functions).Error; err != nil {
+		return err
+	}
+
+	rs := []models.Replication{}
+	if err := db.Find(&rs).Error; err != nil {
+		return err
+	}
+
+	current := map[event.TargetID]bool{}
+	for _, resource := range resources {
+		addTarget(resource)
+		current[newResourceTarget(resource).ID()] = true
+	}
+	for _, t := range registered {
+		addRegisteredTarget(t)
+		current[registeredTargetID(t.Name, t.Type)] = true
+	}
+	for _, f := range functions {
+		addFunctionTarget(f)
+		current[functionTargetID(f.AccountID, f.Name)] = true
+	}
+	for _, r := range rs {
+		addReplicationTarget(r)
+		current[replicationTargetID(r.Bucket)] = true
+	}
+
+	for _, id := range targetList.List() {
+		if current[id] {
+			continue
+		}
+
+		if id.Service == replicationService {
+			removeReplicationTarget(id.Name)
+		} else {
+			removeRegisteredTarget(id)
+		}
+	}
+
+	return nil
+}
+
+func applyResourceChange(payload string) {
+	change := models.ResourceChange{}
+	if err := json.Unmarshal([]byte(payload), &change); err != nil {
+		log.Printf("invalid resource change %q: %v", payload, err)
+		return
+	}
+
+	resource, err := models.ParseARN(change.ARN)
+	if err != nil {
+		log.Printf("invalid resource change %q: %v", payload, err)
+		return
+	}
+
+	switch change.Action {
+	case "create":
+		addTarget(*resource)
+	case "delete":
+		removeTargets(newResourceTarget(*resource).ID())
+	}
+}
+
+// SetTargetList fills the notification target list with the queues, topics,
+// registered targets, functions and replicated buckets in the database and
+// keeps it up to date with the changes other processes announce.
+func SetTargetList() {
+	client := models.GetCache()
+	channels := []string{models.ResourceChannel, models.TargetChannel, models.FunctionChannel, models.ReplicationChannel}
+	pubsub := client.Subscribe(channels...)
+	for range channels {
+		if _, err := pubsub.Receive(); err != nil {
+			log.Fatalf("subscribing to notification target changes failed: %v", err)
+		}
+	}
+
+	if err := reloadTargets(); err != nil {
+		log.Fatalf("loading notification targets failed: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(targetReloadInterval)
+		defer ticker.Stop()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case msg := <-messages:
+				switch msg.Channel {
+				case models.TargetChannel:
+					applyTargetChange(msg.Payload)
+				case models.FunctionChannel:
+					applyFunctionChange(msg.Payload)
+				case models.ReplicationChannel:
+					applyReplicationChange(msg.Payload)
+				default:
+					applyResourceChange(msg.Payload)
+				}
+			case <-ticker.C:
+				if err := reloadTargets(); err != nil {
+					log.Printf("reloading notification targets failed: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -15,7 +15,10 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package controllers
 
 import (
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minio/minio/cmd"
@@ -32,13 +35,36 @@ func CreateTopic(c *gin.Context) {
 	}
 
 	topicName := c.PostForm("Name")
-	db := models.GetDB()
+	attributes := parseAttributes(c)
+	fifo := attributes["FifoTopic"] == "true"
+	contentBasedDeduplication := attributes["ContentBasedDeduplication"] == "true"
 
-	topic := models.Resource{}
-	db.Where(models.Resource{
+	topic := models.Resource{
 		Service:   models.SNS,
 		AccountID: accountID,
 		Name:      topicName,
+	}
+
+	if fifo != topic.IsFIFO() {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Fifo Topic names must end with .fifo and Standard Topic names must not")
+		return
+	}
+
+	if contentBasedDeduplication && !fifo {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: ContentBasedDeduplication is only valid for FIFO topics")
+		return
+	}
+
+	payloadFormat := attributes["PayloadFormat"]
+	if err := validatePayloadFormat(payloadFormat, false); err != nil {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: PayloadFormat: "+err.Error())
+		return
+	}
+
+	db := models.GetDB()
+	db.Where(topic).Attrs(models.Resource{
+		ContentBasedDeduplication: contentBasedDeduplication,
+		PayloadFormat:             payloadFormat,
 	}).FirstOrCreate(&topic)
 
 	requestID, _ := uuid.NewV4()
@@ -95,11 +121,14 @@ func DeleteTopic(c *gin.Context) {
 		return
 	}
 
-	db.Where(models.Resource{
+	if db.Where(models.Resource{
 		Service:   models.SNS,
 		AccountID: targetTopic.AccountID,
 		Name:      targetTopic.Name,
-	}).First(&topic)
+	}).First(&topic).RecordNotFound() {
+		writeSenderErrorResponse(c, http.StatusNotFound, "NotFound", "Topic does not exist")
+		return
+	}
 
 	db.Delete(&topic)
 
@@ -120,24 +149,72 @@ func Subscribe(c *gin.Context) {
 
 	endpointURI := c.PostForm("Endpoint")
 	protocol := c.PostForm("Protocol")
-	topicARN := c.PostForm("TopicArn")
-	targetTopic, _ := models.ParseARN(topicARN)
-	targetTopic.AccountID = accountID
+	topic, ok := findTopic(c, c.PostForm("TopicArn"))
+	if !ok {
+		return
+	}
 
-	db := models.GetDB()
-	topic := models.Resource{}
-	db.Where(targetTopic).First(&topic)
+	if !isTopicActionAllowed(accountID, topic, "Subscribe") {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	if !models.IsValidProtocol(protocol) {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Protocol")
+		return
+	}
+
+	if err := validateEndpoint(protocol, endpointURI); err != nil {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Endpoint: "+err.Error())
+		return
+	}
+	if isEmailProtocol(protocol) {
+		endpointURI, _ = emailAddress(endpointURI)
+	}
+
+	// Messages may only be pushed into an existing queue of the subscriber.
+	if protocol == "sqs" {
+		queue, _ := models.ParseARN(endpointURI)
+		if queue.AccountID != accountID || models.GetDB().Where(queue).First(&models.Resource{}).RecordNotFound() {
+			writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Endpoint: queue does not exist or belongs to another account")
+			return
+		}
+	}
+
+	if topic.IsFIFO() || protocol == "sqs" {
+		queue, _ := models.ParseARN(endpointURI)
+		if protocol != "sqs" || topic.IsFIFO() != queue.IsFIFO() {
+			writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Endpoint: FIFO topics can only be subscribed by FIFO queues")
+			return
+		}
+	}
 
 	endpointID, _ := uuid.NewV4()
-	db.Model(&topic).Association("Endpoints").Append(models.Endpoint{
-		Protocol: protocol,
-		URI:      endpointURI,
-		Name:     endpointID.String(),
-	})
+	token, _ := uuid.NewV4()
+	endpoint := models.Endpoint{
+		Protocol:            protocol,
+		URI:                 endpointURI,
+		Name:                endpointID.String(),
+		Token:               token.String(),
+		PendingConfirmation: isEmailProtocol(protocol),
+		Owner:               accountID,
+	}
+	db := models.GetDB()
+	db.Model(&topic).Association("Endpoints").Append(endpoint)
+
+	subscriptionARN := topic.ARN() + ":" + endpointID.String()
+	if endpoint.PendingConfirmation {
+		subscriptionARN = "pending confirmation"
+		go func() {
+			if err := sendConfirmationMail(topic, endpoint); err != nil {
+				log.Printf("sending confirmation to %s failed: %v", endpoint.URI, err)
+			}
+		}()
+	}
 
 	requestID, _ := uuid.NewV4()
 	body := SubscribeResponse{
-		SubscriptionARN: topic.ARN() + ":" + endpointID.String(),
+		SubscriptionARN: subscriptionARN,
 		RequestID:       requestID.String(),
 	}
 
@@ -155,17 +232,49 @@ func ListSubscriptions(c *gin.Context) {
 	db := models.GetDB()
 	db.Where(models.Resource{AccountID: accountID}).Find(&topics)
 
+	// subscriptions made by this account to topics of other accounts, each
+	// topic listed once however many of its endpoints the account owns
+	foreignEndpoints := []models.Endpoint{}
+	db.Where(models.Endpoint{Owner: accountID}).Find(&foreignEndpoints)
+	foreignTopicIDs := []uint{}
+	seen := map[uint]bool{}
+	for _, endpoint := range foreignEndpoints {
+		if !seen[endpoint.ResourceID] {
+			seen[endpoint.ResourceID] = true
+			foreignTopicIDs = append(foreignTopicIDs, endpoint.ResourceID)
+		}
+	}
+	if len(foreignTopicIDs) > 0 {
+		foreignTopics := []models.Resource{}
+		db.Where("id IN (?) AND account_id <> ?", foreignTopicIDs, accountID).Find(&foreignTopics)
+		topics = append(topics, foreignTopics...)
+	}
+
 	subscriptionARNs := []SubscriptionARN{}
 	for _, topic := range topics {
 		endpoints := []models.Endpoint{}
 		db.Model(&topic).Association("Endpoints").Find(&endpoints)
 		if len(endpoints) > 0 {
 			for _, endpoint := range endpoints {
+				if topic.AccountID != accountID && endpoint.Owner != accountID {
+					continue
+				}
+
+				arn := topic.ARN() + ":" + endpoint.Name
+				if endpoint.PendingConfirmation {
+					arn = "PendingConfirmation"
+				}
+
+				owner := endpoint.Owner
+				if owner == "" {
+					owner = topic.AccountID
+				}
+
 				subscriptionARNs = append(subscriptionARNs, SubscriptionARN{
 					TopicARN: topic.ARN(),
 					Protocol: endpoint.Protocol,
-					ARN:      topic.ARN() + ":" + endpoint.Name,
-					Owner:    topic.AccountID,
+					ARN:      arn,
+					Owner:    owner,
 				})
 			}
 		}
@@ -186,17 +295,98 @@ func Unsubscribe(c *gin.Context) {
 		return
 	}
 
-	subscriptionARN := c.PostForm("SubscriptionArn")
-	targetTopic, _ := models.ParseARN(subscriptionARN)
-	targetSubscription, _ := models.ParseSubscription(subscriptionARN)
+	topic, subscription, ok := findSubscription(c, c.PostForm("SubscriptionArn"))
+	if !ok {
+		return
+	}
+
+	if accountID != topic.AccountID && accountID != subscription.Owner {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	db := models.GetDB()
+	db.Delete(&subscription)
+	closeBrokerTarget(subscription.Name)
 
+	requestID, _ := uuid.NewV4()
+	body := UnsubscribeResponse{
+		RequestID: requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+// ConfirmSubscription is reached through the link mailed to a pending
+// subscription, so the token takes the place of authentication.
+func ConfirmSubscription(c *gin.Context) {
+	var topicARN, token string
+	switch c.Request.Method {
+	case "GET":
+		topicARN = c.Query("TopicArn")
+		token = c.Query("Token")
+	case "POST":
+		topicARN = c.PostForm("TopicArn")
+		token = c.PostForm("Token")
+	}
+
+	targetTopic, err := models.ParseARN(topicARN)
+	if err != nil || token == "" {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: TopicArn or Token")
+		return
+	}
+
+	db := models.GetDB()
 	topic := models.Resource{}
+	if db.Where(targetTopic).First(&topic).RecordNotFound() {
+		writeSenderErrorResponse(c, http.StatusNotFound, "NotFound", "Topic does not exist")
+		return
+	}
+
 	subscription := models.Endpoint{}
+	if db.Where(models.Endpoint{ResourceID: topic.ID, Token: token}).First(&subscription).RecordNotFound() {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid token")
+		return
+	}
+
+	db.Model(&subscription).Update("pending_confirmation", false)
+
+	requestID, _ := uuid.NewV4()
+	body := ConfirmSubscriptionResponse{
+		SubscriptionARN: topic.ARN() + ":" + subscription.Name,
+		RequestID:       requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+// UnsubscribeByToken handles the unsubscribe link included in every mailed
+// notification.
+func UnsubscribeByToken(c *gin.Context) {
+	subscriptionARN := c.Query("SubscriptionArn")
+	token := c.Query("Token")
+
+	targetTopic, err := models.ParseARN(subscriptionARN)
+	if err != nil || token == "" {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: SubscriptionArn or Token")
+		return
+	}
+	targetSubscription, err := models.ParseSubscription(subscriptionARN)
+	if err != nil {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: SubscriptionArn")
+		return
+	}
+
 	db := models.GetDB()
-	targetTopic.AccountID = accountID
+	topic := models.Resource{}
+	subscription := models.Endpoint{}
 	db.Where(targetTopic).First(&topic)
 	targetSubscription.ResourceID = topic.ID
-	db.Where(targetSubscription).First(&subscription)
+	targetSubscription.Token = token
+	if topic.ID == 0 || db.Where(targetSubscription).First(&subscription).RecordNotFound() {
+		writeSenderErrorResponse(c, http.StatusNotFound, "NotFound", "Subscription does not exist")
+		return
+	}
 
 	db.Delete(&subscription)
 
@@ -207,3 +397,482 @@ func Unsubscribe(c *gin.Context) {
 
 	c.XML(http.StatusOK, body)
 }
+
+func Publish(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	topic, ok := findTopic(c, c.PostForm("TopicArn"))
+	if !ok {
+		return
+	}
+
+	if !isTopicActionAllowed(accountID, topic, "Publish") {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	messageID, sequenceNumber, publishErr := publishMessage(topic, publishInput{
+		Subject:                c.PostForm("Subject"),
+		Message:                c.PostForm("Message"),
+		MessageGroupID:         c.PostForm("MessageGroupId"),
+		MessageDeduplicationID: c.PostForm("MessageDeduplicationId"),
+	})
+	if publishErr != nil {
+		writeSenderErrorResponse(c, publishErr.StatusCode, publishErr.Code, publishErr.Message)
+		return
+	}
+
+	requestID, _ := uuid.NewV4()
+	body := PublishResponse{
+		MessageID:      messageID,
+		SequenceNumber: sequenceNumber,
+		RequestID:      requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+func PublishBatch(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	ids := []string{}
+	inputs := []publishInput{}
+	for i := 1; ; i++ {
+		prefix := fmt.Sprintf("PublishBatchRequestEntries.member.%d.", i)
+		id, ok := c.GetPostForm(prefix + "Id")
+		if !ok {
+			break
+		}
+
+		ids = append(ids, id)
+		inputs = append(inputs, publishInput{
+			Subject:                c.PostForm(prefix + "Subject"),
+			Message:                c.PostForm(prefix + "Message"),
+			MessageGroupID:         c.PostForm(prefix + "MessageGroupId"),
+			MessageDeduplicationID: c.PostForm(prefix + "MessageDeduplicationId"),
+		})
+	}
+
+	if len(ids) == 0 {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "EmptyBatchRequest", "The batch request doesn't contain any entries.")
+		return
+	}
+
+	if len(ids) > maxBatchEntries {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "TooManyEntriesInBatchRequest", "The batch request contains more entries than permissible.")
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			writeSenderErrorResponse(c, http.StatusBadRequest, "BatchEntryIdsNotDistinct", "Two or more batch entries in the request have the same Id.")
+			return
+		}
+		seen[id] = true
+	}
+
+	topic, ok := findTopic(c, c.PostForm("TopicArn"))
+	if !ok {
+		return
+	}
+
+	if !isTopicActionAllowed(accountID, topic, "Publish") {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	successful := []PublishBatchResultEntry{}
+	failed := []BatchResultErrorEntry{}
+	for i, input := range inputs {
+		messageID, sequenceNumber, publishErr := publishMessage(topic, input)
+		if publishErr != nil {
+			failed = append(failed, BatchResultErrorEntry{
+				ID:          ids[i],
+				Code:        publishErr.Code,
+				Message:     publishErr.Message,
+				SenderFault: publishErr.StatusCode < http.StatusInternalServerError,
+			})
+			continue
+		}
+
+		successful = append(successful, PublishBatchResultEntry{
+			ID:             ids[i],
+			MessageID:      messageID,
+			SequenceNumber: sequenceNumber,
+		})
+	}
+
+	requestID, _ := uuid.NewV4()
+	body := PublishBatchResponse{
+		Successful: successful,
+		Failed:     failed,
+		RequestID:  requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+// findTopic looks up the topic named by topicARN, writing an error response
+// and returning false when it does not exist.
+func findTopic(c *gin.Context, topicARN string) (models.Resource, bool) {
+	topic := models.Resource{}
+
+	targetTopic, err := models.ParseARN(topicARN)
+	if err != nil || targetTopic.Service != models.SNS {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: TopicArn")
+		return topic, false
+	}
+
+	db := models.GetDB()
+	if db.Where(targetTopic).First(&topic).RecordNotFound() {
+		writeSenderErrorResponse(c, http.StatusNotFound, "NotFound", "Topic does not exist")
+		return topic, false
+	}
+
+	return topic, true
+}
+
+// findSubscription looks up the subscription named by subscriptionARN
+// together with its topic, writing an error response and returning false
+// when it does not exist.
+func findSubscription(c *gin.Context, subscriptionARN string) (models.Resource, models.Endpoint, bool) {
+	topic := models.Resource{}
+	subscription := models.Endpoint{}
+
+	targetTopic, err := models.ParseARN(subscriptionARN)
+	if err != nil {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: SubscriptionArn")
+		return topic, subscription, false
+	}
+	targetSubscription, err := models.ParseSubscription(subscriptionARN)
+	if err != nil {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: SubscriptionArn")
+		return topic, subscription, false
+	}
+
+	db := models.GetDB()
+	db.Where(targetTopic).First(&topic)
+	targetSubscription.ResourceID = topic.ID
+	if topic.ID == 0 || db.Where(targetSubscription).First(&subscription).RecordNotFound() {
+		writeSenderErrorResponse(c, http.StatusNotFound, "NotFound", "Subscription does not exist")
+		return topic, subscription, false
+	}
+
+	return topic, subscription, true
+}
+
+func GetSubscriptionAttributes(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	topic, subscription, ok := findSubscription(c, c.PostForm("SubscriptionArn"))
+	if !ok {
+		return
+	}
+
+	if accountID != topic.AccountID && accountID != subscription.Owner {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	owner := subscription.Owner
+	if owner == "" {
+		owner = topic.AccountID
+	}
+
+	attributes := []Attribute{
+		{Key: "SubscriptionArn", Value: topic.ARN() + ":" + subscription.Name},
+		{Key: "TopicArn", Value: topic.ARN()},
+		{Key: "Owner", Value: owner},
+		{Key: "Protocol", Value: subscription.Protocol},
+		{Key: "Endpoint", Value: subscription.URI},
+		{Key: "PendingConfirmation", Value: strconv.FormatBool(subscription.PendingConfirmation)},
+	}
+	if subscription.RedrivePolicy != "" {
+		attributes = append(attributes, Attribute{Key: "RedrivePolicy", Value: subscription.RedrivePolicy})
+	}
+
+	requestID, _ := uuid.NewV4()
+	body := GetSubscriptionAttributesResponse{
+		Attributes: attributes,
+		RequestID:  requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+func SetSubscriptionAttributes(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	topic, subscription, ok := findSubscription(c, c.PostForm("SubscriptionArn"))
+	if !ok {
+		return
+	}
+
+	if accountID != topic.AccountID && accountID != subscription.Owner {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	db := models.GetDB()
+	value := c.PostForm("AttributeValue")
+	switch c.PostForm("AttributeName") {
+	case "RedrivePolicy":
+		if value != "" {
+			policy, err := models.ParseRedrivePolicy(value)
+			if err != nil {
+				writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: RedrivePolicy: "+err.Error())
+				return
+			}
+
+			queue, _ := models.ParseARN(policy.DeadLetterTargetARN)
+			if db.Where(queue).First(&models.Resource{}).RecordNotFound() {
+				writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: RedrivePolicy: dead-letter queue does not exist")
+				return
+			}
+
+			// Failed messages may only go to a queue of the subscriber or
+			// of the topic owner.
+			if queue.AccountID != subscription.Owner && queue.AccountID != topic.AccountID {
+				writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: RedrivePolicy: dead-letter queue belongs to another account")
+				return
+			}
+		}
+		db.Model(&subscription).Update("redrive_policy", value)
+	default:
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: AttributeName")
+		return
+	}
+
+	requestID, _ := uuid.NewV4()
+	body := SetSubscriptionAttributesResponse{
+		RequestID: requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+func GetTopicAttributes(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	topic, ok := findTopic(c, c.PostForm("TopicArn"))
+	if !ok {
+		return
+	}
+
+	if !isTopicActionAllowed(accountID, topic, "GetTopicAttributes") {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	policy := topic.Policy
+	if policy == "" {
+		policy = models.NewPolicy().String()
+	}
+
+	db := models.GetDB()
+	confirmed, pending := 0, 0
+	db.Model(&models.Endpoint{}).Where("resource_id = ? AND pending_confirmation = ?", topic.ID, false).Count(&confirmed)
+	db.Model(&models.Endpoint{}).Where("resource_id = ? AND pending_confirmation = ?", topic.ID, true).Count(&pending)
+
+	attributes := []Attribute{
+		{Key: "TopicArn", Value: topic.ARN()},
+		{Key: "Owner", Value: topic.AccountID},
+		{Key: "Policy", Value: policy},
+		{Key: "SubscriptionsConfirmed", Value: strconv.Itoa(confirmed)},
+		{Key: "SubscriptionsPending", Value: strconv.Itoa(pending)},
+	}
+	if topic.IsFIFO() {
+		attributes = append(attributes,
+			Attribute{Key: "FifoTopic", Value: "true"},
+			Attribute{Key: "ContentBasedDeduplication", Value: strconv.FormatBool(topic.ContentBasedDeduplication)},
+		)
+	}
+	if topic.PayloadFormat != "" {
+		attributes = append(attributes, Attribute{Key: "PayloadFormat", Value: topic.PayloadFormat})
+	}
+
+	requestID, _ := uuid.NewV4()
+	body := GetTopicAttributesResponse{
+		Attributes: attributes,
+		RequestID:  requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+func SetTopicAttributes(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	topic, ok := findTopic(c, c.PostForm("TopicArn"))
+	if !ok {
+		return
+	}
+
+	if !isTopicActionAllowed(accountID, topic, "SetTopicAttributes") {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	db := models.GetDB()
+	value := c.PostForm("AttributeValue")
+	switch c.PostForm("AttributeName") {
+	case "Policy":
+		if _, err := models.ParsePolicy(value); err != nil {
+			writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Policy: "+err.Error())
+			return
+		}
+		db.Model(&topic).Update("policy", value)
+	case "ContentBasedDeduplication":
+		if !topic.IsFIFO() {
+			writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: ContentBasedDeduplication is only valid for FIFO topics")
+			return
+		}
+		db.Model(&topic).Update("content_based_deduplication", value == "true")
+	case "PayloadFormat":
+		if err := validatePayloadFormat(value, false); err != nil {
+			writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: PayloadFormat: "+err.Error())
+			return
+		}
+		db.Model(&topic).Update("payload_format", value)
+	default:
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: AttributeName")
+		return
+	}
+
+	requestID, _ := uuid.NewV4()
+	body := SetTopicAttributesResponse{
+		RequestID: requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+func AddPermission(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	topic, ok := findTopic(c, c.PostForm("TopicArn"))
+	if !ok {
+		return
+	}
+
+	if !isTopicActionAllowed(accountID, topic, "AddPermission") {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	label := c.PostForm("Label")
+	principals := models.StringList{}
+	actions := models.StringList{}
+	for i := 1; ; i++ {
+		id, ok := c.GetPostForm(fmt.Sprintf("AWSAccountId.member.%d", i))
+		if !ok {
+			break
+		}
+		principals = append(principals, fmt.Sprintf("arn:aws:iam::%s:root", id))
+	}
+	for i := 1; ; i++ {
+		action, ok := c.GetPostForm(fmt.Sprintf("ActionName.member.%d", i))
+		if !ok {
+			break
+		}
+		actions = append(actions, "SNS:"+action)
+	}
+
+	if label == "" || len(principals) == 0 || len(actions) == 0 {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Label, AWSAccountId and ActionName are required")
+		return
+	}
+
+	policy, err := models.ParsePolicy(topic.Policy)
+	if err != nil {
+		policy = models.NewPolicy()
+	}
+
+	err = policy.AddStatement(models.Statement{
+		Sid:       label,
+		Effect:    "Allow",
+		Principal: models.Principal{AWS: principals},
+		Action:    actions,
+		Resource:  models.StringList{topic.ARN()},
+	})
+	if err != nil {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Label: "+err.Error())
+		return
+	}
+
+	db := models.GetDB()
+	db.Model(&topic).Update("policy", policy.String())
+
+	requestID, _ := uuid.NewV4()
+	body := AddPermissionResponse{
+		RequestID: requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
+
+func RemovePermission(c *gin.Context) {
+	accountID, errCode := authenticate(c.Request)
+	if errCode != cmd.ErrNone {
+		writeErrorResponse(c, errCode)
+		return
+	}
+
+	topic, ok := findTopic(c, c.PostForm("TopicArn"))
+	if !ok {
+		return
+	}
+
+	if !isTopicActionAllowed(accountID, topic, "RemovePermission") {
+		writeErrorResponse(c, cmd.ErrAuthorizationError)
+		return
+	}
+
+	policy, err := models.ParsePolicy(topic.Policy)
+	if err == nil {
+		err = policy.RemoveStatement(c.PostForm("Label"))
+	}
+	if err != nil {
+		writeSenderErrorResponse(c, http.StatusBadRequest, "InvalidParameter", "Invalid parameter: Label: "+err.Error())
+		return
+	}
+
+	db := models.GetDB()
+	db.Model(&topic).Update("policy", policy.String())
+
+	requestID, _ := uuid.NewV4()
+	body := RemovePermissionResponse{
+		RequestID: requestID.String(),
+	}
+
+	c.XML(http.StatusOK, body)
+}
@@ -32,7 +32,7 @@ func SetDB() {
 }
 
 func Migrate() {
-	db.AutoMigrate(&Resource{}, &Endpoint{})
+	db.AutoMigrate(&Resource{}, &Endpoint{}, &OutboxEvent{}, &EventLog{}, &Target{}, &EventRule{}, &Function{}, &FunctionInvocation{}, &LogMarker{}, &Replication{}, &ReplicationStatus{})
 }
 
 func GetDB() *gorm.DB {
@@ -15,26 +15,76 @@ Licensed under the Apache License, Version 2.0 (the "License");
 package models
 
 import (
+	"encoding/json"
 	"strings"
 
 	"github.com/jinzhu/gorm"
 	"github.com/minio/minio/pkg/event"
 )
 
+var protocols = map[string]bool{
+	"http":       true,
+	"https":      true,
+	"sqs":        true,
+	"kafka":      true,
+	"amqp":       true,
+	"nats":       true,
+	"mqtt":       true,
+	"redis":      true,
+	"email":      true,
+	"email-json": true,
+}
+
+// IsValidProtocol reports whether subscriptions may use the given protocol.
+func IsValidProtocol(protocol string) bool {
+	return protocols[protocol]
+}
+
 type Endpoint struct {
 	gorm.Model
-	Protocol   string
-	URI        string
-	Name       string
-	ResourceID uint
+	Protocol            string
+	URI                 string
+	Name                string
+	Token               string
+	PendingConfirmation bool
+	Owner               string
+	RedrivePolicy       string `gorm:"type:text"`
+	ResourceID          uint
+}
+
+// RedrivePolicy names the queue which receives messages that could not be
+// delivered to a subscription.
+type RedrivePolicy struct {
+	DeadLetterTargetARN string `json:"deadLetterTargetArn"`
+}
+
+func ParseRedrivePolicy(s string) (*RedrivePolicy, error) {
+	policy := RedrivePolicy{}
+	if err := json.Unmarshal([]byte(s), &policy); err != nil {
+		return nil, err
+	}
+
+	queue, err := ParseARN(policy.DeadLetterTargetARN)
+	if err != nil {
+		return nil, err
+	}
+
+	if queue.Service != SQS {
+		return nil, &event.ErrInvalidARN{ARN: policy.DeadLetterTargetARN}
+	}
+
+	return &policy, nil
 }
 
 func ParseSubscription(s string) (*Endpoint, error) {
 	if _, err := ParseARN(s); err != nil {
-		return nil, &event.ErrInvalidARN{s}
+		return nil, &event.ErrInvalidARN{ARN: s}
 	}
 
 	tokens := strings.Split(s, ":")
+	if len(tokens) != 7 || tokens[6] == "" {
+		return nil, &event.ErrInvalidARN{ARN: s}
+	}
 
 	return &Endpoint{
 		Name: tokens[6],
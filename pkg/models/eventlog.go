@@ -0,0 +1,32 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"time"
+)
+
+// EventLog is a bucket event sent to a target, kept for the retention
+// period so it can be replayed.
+type EventLog struct {
+	ID            uint      `gorm:"primary_key"`
+	Bucket        string    `gorm:"index:idx_event_logs_bucket_time"`
+	EventTime     time.Time `gorm:"index:idx_event_logs_bucket_time"`
+	EventName     string
+	TargetService string
+	TargetAccount string
+	TargetName    string
+	Payload       string `gorm:"type:mediumtext"`
+}
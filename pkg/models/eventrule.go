@@ -0,0 +1,56 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// EventRuleChannel is where changes of event rules are announced, with the
+// id of the account whose rules changed as the message.
+const EventRuleChannel = "eventrules"
+
+// EventRule sends the bucket events of an account which match its pattern
+// to its targets, next to the notification configurations of the buckets.
+// Targets holds a JSON list of target ARNs.
+type EventRule struct {
+	gorm.Model
+	AccountID string `gorm:"unique_index:idx_event_rules_account_name"`
+	Name      string `gorm:"unique_index:idx_event_rules_account_name"`
+	Pattern   string `gorm:"type:text"`
+	Targets   string `gorm:"type:text"`
+}
+
+func (r *EventRule) AfterSave() error {
+	publishEventRuleChange(r)
+	return nil
+}
+
+func (r *EventRule) AfterDelete() error {
+	publishEventRuleChange(r)
+	return nil
+}
+
+func publishEventRuleChange(r *EventRule) {
+	if client == nil {
+		return
+	}
+
+	if err := client.Publish(EventRuleChannel, r.AccountID).Err(); err != nil {
+		log.Printf("announcing change of rule %s of %s failed: %v", r.Name, r.AccountID, err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+)
+
+// FunctionChannel is where changes of functions are announced, with
+// "<account>:<name>" of the function as the message.
+const FunctionChannel = "functions"
+
+const (
+	InvocationSucceeded = "succeeded"
+	InvocationFailed    = "failed"
+	InvocationTimedOut  = "timed-out"
+	InvocationThrottled = "throttled"
+)
+
+// Function is an HTTP invoke URL registered by an administrator, which
+// CloudFunctionConfiguration rules invoke with bucket events. Timeout is in
+// seconds, and Concurrency bounds how many invocations run at once.
+type Function struct {
+	gorm.Model
+	AccountID   string `gorm:"unique_index:idx_functions_account_name"`
+	Name        string `gorm:"unique_index:idx_functions_account_name"`
+	URL         string `gorm:"type:text"`
+	AuthHeader  string
+	Timeout     int
+	Concurrency int
+}
+
+func (f Function) ARN() string {
+	config := config.GetServerConfig()
+
+	return fmt.Sprintf("arn:aws:lambda:%s:%s:function:%s", config.Region, f.AccountID, f.Name)
+}
+
+func (f *Function) AfterSave() error {
+	publishFunctionChange(f)
+	return nil
+}
+
+func (f *Function) AfterDelete() error {
+	publishFunctionChange(f)
+	return nil
+}
+
+func publishFunctionChange(f *Function) {
+	if client == nil {
+		return
+	}
+
+	if err := client.Publish(FunctionChannel, f.AccountID+":"+f.Name).Err(); err != nil {
+		log.Printf("announcing change of %s failed: %v", f.ARN(), err)
+	}
+}
+
+// FunctionInvocation records one invocation of a function with an event.
+type FunctionInvocation struct {
+	ID         uint   `gorm:"primary_key"`
+	AccountID  string `gorm:"index:idx_function_invocations_function"`
+	Function   string `gorm:"index:idx_function_invocations_function"`
+	EventName  string
+	Bucket     string
+	Key        string `gorm:"type:text"`
+	Status     string
+	StatusCode int
+	Duration   time.Duration
+	Error      string    `gorm:"type:text"`
+	CreatedAt  time.Time `gorm:"index"`
+}
@@ -0,0 +1,40 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	EventPending = "pending"
+	EventFailed  = "failed"
+)
+
+// OutboxEvent is a bucket event waiting to be delivered to a target, or
+// one whose delivery failed for good.
+type OutboxEvent struct {
+	gorm.Model
+	TargetService string
+	TargetAccount string `gorm:"index"`
+	TargetName    string
+	Payload       string `gorm:"type:mediumtext"`
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt time.Time `gorm:"index"`
+	LastError     string    `gorm:"type:text"`
+}
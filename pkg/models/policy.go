@@ -0,0 +1,189 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio/pkg/wildcard"
+)
+
+// StringList is a policy element which may be written either as a single
+// string or as an array of strings.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = StringList{s}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	*l = StringList(list)
+	return nil
+}
+
+type Principal struct {
+	AWS StringList `json:"AWS"`
+}
+
+func (p *Principal) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != "*" {
+			return fmt.Errorf("invalid principal %s", s)
+		}
+		p.AWS = StringList{"*"}
+		return nil
+	}
+
+	type principal Principal
+	parsed := principal{}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	*p = Principal(parsed)
+	return nil
+}
+
+func (p Principal) Match(accountID string) bool {
+	for _, aws := range p.AWS {
+		if aws == "*" || aws == accountID || aws == fmt.Sprintf("arn:aws:iam::%s:root", accountID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Statement struct {
+	Sid       string     `json:"Sid,omitempty"`
+	Effect    string     `json:"Effect"`
+	Principal Principal  `json:"Principal"`
+	Action    StringList `json:"Action"`
+	Resource  StringList `json:"Resource"`
+}
+
+func (s Statement) matchAction(action string) bool {
+	for _, pattern := range s.Action {
+		if wildcard.Match(strings.ToLower(pattern), strings.ToLower(action)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s Statement) matchResource(resource string) bool {
+	for _, pattern := range s.Resource {
+		if wildcard.Match(pattern, resource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Policy is the access policy document attached to a topic.
+type Policy struct {
+	Version   string      `json:"Version"`
+	ID        string      `json:"Id,omitempty"`
+	Statement []Statement `json:"Statement"`
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		Version:   "2008-10-17",
+		ID:        "__default_policy_ID",
+		Statement: []Statement{},
+	}
+}
+
+func ParsePolicy(s string) (*Policy, error) {
+	if s == "" {
+		return NewPolicy(), nil
+	}
+
+	policy := Policy{}
+	if err := json.Unmarshal([]byte(s), &policy); err != nil {
+		return nil, err
+	}
+
+	for _, statement := range policy.Statement {
+		if statement.Effect != "Allow" && statement.Effect != "Deny" {
+			return nil, fmt.Errorf("invalid effect %s", statement.Effect)
+		}
+
+		if len(statement.Action) == 0 || len(statement.Resource) == 0 {
+			return nil, errors.New("statement requires action and resource")
+		}
+	}
+
+	return &policy, nil
+}
+
+func (p Policy) String() string {
+	data, _ := json.Marshal(p)
+	return string(data)
+}
+
+// IsAllowed reports whether accountID may perform action on resource. An
+// explicit Deny overrides any Allow.
+func (p Policy) IsAllowed(accountID, action, resource string) bool {
+	allowed := false
+	for _, statement := range p.Statement {
+		if !statement.Principal.Match(accountID) || !statement.matchAction(action) || !statement.matchResource(resource) {
+			continue
+		}
+
+		if statement.Effect == "Deny" {
+			return false
+		}
+		allowed = true
+	}
+
+	return allowed
+}
+
+func (p *Policy) AddStatement(statement Statement) error {
+	for _, s := range p.Statement {
+		if s.Sid == statement.Sid {
+			return fmt.Errorf("statement %s already exists", statement.Sid)
+		}
+	}
+
+	p.Statement = append(p.Statement, statement)
+	return nil
+}
+
+func (p *Policy) RemoveStatement(sid string) error {
+	for i, s := range p.Statement {
+		if s.Sid == sid {
+			p.Statement = append(p.Statement[:i], p.Statement[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("statement %s does not exist", sid)
+}
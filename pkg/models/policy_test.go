@@ -0,0 +1,69 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/inwinstack/kaoliang/pkg/models"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPolicy(t *testing.T) {
+	topicARN := "arn:aws:sns:us-east-1:owner:foobar"
+
+	Convey("Given a policy allowing another account to publish", t, func() {
+		policy, err := models.ParsePolicy(`{
+			"Version": "2008-10-17",
+			"Statement": [{
+				"Sid": "publish",
+				"Effect": "Allow",
+				"Principal": {"AWS": "arn:aws:iam::partner:root"},
+				"Action": "SNS:Publish",
+				"Resource": "arn:aws:sns:us-east-1:owner:*"
+			}]
+		}`)
+		So(err, ShouldBeNil)
+
+		Convey("The account should be allowed to publish", func() {
+			So(policy.IsAllowed("partner", "SNS:Publish", topicARN), ShouldBeTrue)
+		})
+
+		Convey("The account should not be allowed to subscribe", func() {
+			So(policy.IsAllowed("partner", "SNS:Subscribe", topicARN), ShouldBeFalse)
+		})
+
+		Convey("Other accounts should not be allowed to publish", func() {
+			So(policy.IsAllowed("stranger", "SNS:Publish", topicARN), ShouldBeFalse)
+		})
+
+		Convey("When a statement denies publishing to everyone", func() {
+			policy.AddStatement(models.Statement{
+				Sid:       "deny",
+				Effect:    "Deny",
+				Principal: models.Principal{AWS: models.StringList{"*"}},
+				Action:    models.StringList{"sns:*"},
+				Resource:  models.StringList{topicARN},
+			})
+
+			Convey("The deny should win over the allow", func() {
+				So(policy.IsAllowed("partner", "SNS:Publish", topicARN), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the statement is removed", func() {
+			So(policy.RemoveStatement("publish"), ShouldBeNil)
+
+			Convey("The account should no longer be allowed to publish", func() {
+				So(policy.IsAllowed("partner", "SNS:Publish", topicARN), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given a policy with an unknown effect", t, func() {
+		_, err := models.ParsePolicy(`{"Statement": [{"Effect": "Maybe", "Principal": "*", "Action": "SNS:Publish", "Resource": "*"}]}`)
+
+		Convey("Parsing should fail", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
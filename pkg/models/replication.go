@@ -0,0 +1,89 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ReplicationChannel is where changes of bucket replications are announced,
+// with the name of the bucket as the message.
+const ReplicationChannel = "replications"
+
+const (
+	ReplicationPending   = "pending"
+	ReplicationCompleted = "completed"
+	ReplicationFailed    = "failed"
+)
+
+// Replication copies the objects of a bucket to a bucket of another S3
+// endpoint as they are created and deleted. Prefixes is a JSON array of
+// the key prefixes to copy, all keys when empty, and StorageClasses a JSON
+// object mapping storage classes of the bucket to ones of the destination.
+type Replication struct {
+	gorm.Model
+	Bucket            string `gorm:"unique_index"`
+	Endpoint          string `gorm:"type:text"`
+	Region            string
+	DestinationBucket string
+	AccessKey         string
+	SecretKey         string
+	Prefixes          string `gorm:"type:text"`
+	StorageClasses    string `gorm:"type:text"`
+}
+
+func (r *Replication) AfterSave() error {
+	publishReplicationChange(r)
+	return nil
+}
+
+func (r *Replication) AfterDelete() error {
+	publishReplicationChange(r)
+	return nil
+}
+
+func publishReplicationChange(r *Replication) {
+	if client == nil {
+		return
+	}
+
+	if err := client.Publish(ReplicationChannel, r.Bucket).Err(); err != nil {
+		log.Printf("announcing change of replication of %s failed: %v", r.Bucket, err)
+	}
+}
+
+// ReplicationStatus is how the latest change of an object was replicated.
+// Keys are too long to be indexed, so objects are looked up by the hash of
+// their key.
+type ReplicationStatus struct {
+	ID        uint   `gorm:"primary_key"`
+	Bucket    string `gorm:"unique_index:idx_replication_statuses_object"`
+	KeyHash   string `gorm:"unique_index:idx_replication_statuses_object"`
+	Key       string `gorm:"type:text"`
+	Operation string
+	Status    string `gorm:"index"`
+	Attempts  int
+	LastError string `gorm:"type:text"`
+	UpdatedAt time.Time
+}
+
+func ReplicationKeyHash(key string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
@@ -16,7 +16,9 @@ package models
 
 import (
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 
 	"github.com/minio/minio/pkg/event"
@@ -58,10 +60,47 @@ func (s Service) Value() (driver.Value, error) {
 type Resource struct {
 	gorm.Model
 	Service
-	AccountID string
-	Type      string
-	Name      string
-	Endpoints []Endpoint
+	AccountID                 string
+	Type                      string
+	Name                      string
+	ContentBasedDeduplication bool
+	Policy                    string `gorm:"type:text"`
+	PayloadFormat             string
+	Endpoints                 []Endpoint
+}
+
+// ResourceChannel is where the creation and deletion of queues and topics
+// are announced, so every kaoliang process can keep its targets in sync.
+const ResourceChannel = "resources"
+
+type ResourceChange struct {
+	Action string `json:"action"`
+	ARN    string `json:"arn"`
+}
+
+func (r *Resource) AfterCreate() error {
+	publishResourceChange("create", r)
+	return nil
+}
+
+func (r *Resource) AfterDelete() error {
+	publishResourceChange("delete", r)
+	return nil
+}
+
+func publishResourceChange(action string, r *Resource) {
+	if client == nil {
+		return
+	}
+
+	data, _ := json.Marshal(ResourceChange{Action: action, ARN: r.ARN()})
+	if err := client.Publish(ResourceChannel, data).Err(); err != nil {
+		log.Printf("announcing %s of %s failed: %v", action, r.ARN(), err)
+	}
+}
+
+func (r Resource) IsFIFO() bool {
+	return strings.HasSuffix(r.Name, ".fifo")
 }
 
 func (r Resource) URL() string {
@@ -32,3 +32,47 @@ func TestARN(t *testing.T) {
 		})
 	})
 }
+
+func TestIsFIFO(t *testing.T) {
+	Convey("Given a topic whose name ends with .fifo", t, func() {
+		topic := models.Resource{
+			Service:   models.SNS,
+			AccountID: "tester",
+			Name:      "orders.fifo",
+		}
+
+		Convey("It should be a FIFO topic", func() {
+			So(topic.IsFIFO(), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a topic with a standard name", t, func() {
+		topic := models.Resource{
+			Service:   models.SNS,
+			AccountID: "tester",
+			Name:      "orders",
+		}
+
+		Convey("It should not be a FIFO topic", func() {
+			So(topic.IsFIFO(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestParseSubscription(t *testing.T) {
+	Convey("Given subscription ARNs", t, func() {
+		Convey("The name of the subscription should be parsed", func() {
+			subscription, err := models.ParseSubscription("arn:aws:sns:us-east-1:tester:foobar:5f2a")
+			So(err, ShouldBeNil)
+			So(subscription.Name, ShouldEqual, "5f2a")
+		})
+
+		Convey("Topic ARNs should be rejected", func() {
+			_, err := models.ParseSubscription("arn:aws:sns:us-east-1:tester:foobar")
+			So(err, ShouldNotBeNil)
+
+			_, err = models.ParseSubscription("arn:aws:sns:us-east-1:tester:foobar:")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
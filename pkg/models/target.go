@@ -0,0 +1,66 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package models
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/inwinstack/kaoliang/pkg/config"
+)
+
+// TargetChannel is where changes of registered targets are announced, with
+// "<name>:<type>" of the target as the message.
+const TargetChannel = "targets"
+
+// Target is a webhook, message broker or database registered by an
+// administrator, which bucket events are sent to directly. Its type says
+// how the endpoint is read.
+type Target struct {
+	gorm.Model
+	Name          string `gorm:"unique_index:idx_targets_name_type"`
+	Type          string `gorm:"unique_index:idx_targets_name_type"`
+	Endpoint      string `gorm:"type:text"`
+	AuthHeader    string
+	PayloadFormat string
+}
+
+func (t Target) ARN() string {
+	config := config.GetServerConfig()
+
+	return fmt.Sprintf("arn:aws:sqs:%s:%s:%s", config.Region, t.Name, t.Type)
+}
+
+func (t *Target) AfterSave() error {
+	publishTargetChange(t)
+	return nil
+}
+
+func (t *Target) AfterDelete() error {
+	publishTargetChange(t)
+	return nil
+}
+
+func publishTargetChange(t *Target) {
+	if client == nil {
+		return
+	}
+
+	if err := client.Publish(TargetChannel, t.Name+":"+t.Type).Err(); err != nil {
+		log.Printf("announcing change of %s failed: %v", t.ARN(), err)
+	}
+}
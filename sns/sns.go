@@ -54,6 +54,16 @@ func main() {
 		c.Status(http.StatusNoContent)
 	})
 
+	r.GET("/", func(c *gin.Context) {
+		action := c.Query("Action")
+		switch action {
+		case "ConfirmSubscription":
+			controllers.ConfirmSubscription(c)
+		case "Unsubscribe":
+			controllers.UnsubscribeByToken(c)
+		}
+	})
+
 	r.POST("/", func(c *gin.Context) {
 		action := c.PostForm("Action")
 		switch action {
@@ -69,6 +79,26 @@ func main() {
 			controllers.ListSubscriptions(c)
 		case "Unsubscribe":
 			controllers.Unsubscribe(c)
+		case "Publish":
+			controllers.Publish(c)
+		case "PublishBatch":
+			controllers.PublishBatch(c)
+		case "ConfirmSubscription":
+			controllers.ConfirmSubscription(c)
+		case "GetTopicAttributes":
+			controllers.GetTopicAttributes(c)
+		case "SetTopicAttributes":
+			controllers.SetTopicAttributes(c)
+		case "AddPermission":
+			controllers.AddPermission(c)
+		case "RemovePermission":
+			controllers.RemovePermission(c)
+		case "GetSubscriptionAttributes":
+			controllers.GetSubscriptionAttributes(c)
+		case "SetSubscriptionAttributes":
+			controllers.SetSubscriptionAttributes(c)
+		case "RedriveDeadLetters":
+			controllers.RedriveDeadLetters(c)
 		}
 	})
 